@@ -11,8 +11,6 @@ import (
 
 	"github.com/ztrue/tracerr"
 	// bencode "github.com/jackpal/bencode-go" // Available if you need it!
-	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
-	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
 )
 
 func decodeString(bencodedString []byte) ([]byte, []byte, error) {
@@ -31,18 +29,24 @@ func decodeString(bencodedString []byte) ([]byte, []byte, error) {
 	if err != nil {
 		return nil, nil, tracerr.Wrap(err)
 	}
+	if length < 0 || firstColonIndex+1+length > len(bencodedString) {
+		return nil, nil, fmt.Errorf("string length %d exceeds input", length)
+	}
 
 	return bencodedString[firstColonIndex+1 : firstColonIndex+1+length], bencodedString[firstColonIndex+1+length:], nil
 }
 
 func decodeInteger(bencodedString []byte) (int, []byte, error) {
-	lastIndex := len(bencodedString) - 1
+	lastIndex := -1
 	for i := 1; i < len(bencodedString); i++ {
 		if bencodedString[i] == 'e' {
 			lastIndex = i
 			break
 		}
 	}
+	if lastIndex == -1 {
+		return -1, nil, fmt.Errorf("unterminated integer")
+	}
 
 	numberStr := bencodedString[1:lastIndex]
 
@@ -54,8 +58,10 @@ func decodeInteger(bencodedString []byte) (int, []byte, error) {
 	return number, bencodedString[lastIndex+1:], nil
 }
 
+// returnLastIndex finds the `e` closing the list or dictionary bencodedString starts with,
+// failing if the input ends before it
 func returnLastIndex(bencodedString []byte) (int, error) {
-	lastIndex := len(bencodedString) - 1
+	lastIndex := -1
 	startPoint := 1
 
 	// if there's a chain of strings
@@ -102,6 +108,9 @@ func returnLastIndex(bencodedString []byte) (int, error) {
 			break
 		}
 	}
+	if lastIndex == -1 {
+		return -1, fmt.Errorf("unterminated list or dictionary")
+	}
 
 	return lastIndex, nil
 }
@@ -166,6 +175,9 @@ func decodeDictionary(bencodedString []byte) (map[string]interface{}, []byte, er
 }
 
 func DecodeBencode(bencodedString []byte) (interface{}, []byte, error) {
+	if len(bencodedString) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end of input")
+	}
 	if unicode.IsDigit(rune(bencodedString[0])) { // bencodedString[0] returns a byte (which shows up as Unicode when printed)
 		s, r, err := decodeString(bencodedString)
 		if utf8.Valid(s) {
@@ -183,17 +195,58 @@ func DecodeBencode(bencodedString []byte) (interface{}, []byte, error) {
 	}
 }
 
+// RawValue returns the bencoded bytes of a value in a dictionary exactly as they appear in it,
+// e.g. the info dictionary of a .torrent file, whose hash must cover keys we don't decode
+func RawValue(bencodedDict []byte, key string) ([]byte, error) {
+	lastIndex, err := returnLastIndex(bencodedDict)
+	if err != nil || len(bencodedDict) == 0 || bencodedDict[0] != 'd' {
+		return nil, fmt.Errorf("invalid dictionary syntax")
+	}
+
+	dict := bencodedDict[1:lastIndex]
+	for len(dict) > 0 {
+		k, rk, err := decodeString(dict)
+		if err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+
+		_, r, err := DecodeBencode(rk)
+		if err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+		if string(k) == key {
+			return rk[:len(rk)-len(r)], nil
+		}
+
+		dict = r
+	}
+
+	return nil, fmt.Errorf("key %q not found", key)
+}
+
+// Bytes returns a decoded string as bytes. DecodeBencode hands strings back as string if they are
+// valid UTF-8 and as []byte otherwise, anything else gives nil
+func Bytes(v interface{}) []byte {
+	switch s := v.(type) {
+	case []byte:
+		return s
+	case string:
+		return []byte(s)
+	}
+	return nil
+}
+
+// String is Bytes as a string
+func String(v interface{}) string {
+	return string(Bytes(v))
+}
+
 func generateSHA1Checksum(data []byte) string {
 	h := sha1.New()
 	h.Write(data)
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func CalculateInfoHash(metadata torrent.TorrentMetadata) string {
-	encodedInfoDict := torrent.EncodeInfoDict(metadata.Info)
-	return util.GenerateSHA1Checksum([]byte(encodedInfoDict))
-}
-
 func SplitPiecesIntoHashes(pieces []byte) []string {
 	hashes := make([]string, 0)
 	for i := 0; i < len(pieces); i += 20 {
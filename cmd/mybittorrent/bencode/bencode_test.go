@@ -0,0 +1,95 @@
+package bencode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeBencode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+		rest  string
+	}{
+		{input: "5:hello", want: "hello"},
+		{input: "0:", want: ""},
+		{input: "i52e", want: 52},
+		{input: "i-52e3:abc", want: -52, rest: "3:abc"},
+		{input: "le", want: []interface{}{}},
+		{input: "l5:helloi52ee", want: []interface{}{"hello", 52}},
+		{input: "d3:foo3:bar5:helloi52ee", want: map[string]interface{}{"foo": "bar", "hello": 52}},
+		{input: "d1:ald1:bi1eeee", want: map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": 1}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, rest, err := DecodeBencode([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("decoded %#v, want %#v", got, tt.want)
+			}
+			if string(rest) != tt.rest {
+				t.Fatalf("rest %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestDecodeBencodeMalformed(t *testing.T) {
+	// none of these may panic, the DHT and extension messages decode whatever arrives
+	inputs := []string{
+		"", "d", "l", "i", "e", "x",
+		"i-e", "ie", "i12", "i1x2e",
+		"d1:a", "d1:ai1e", "d1:ae", "di1ei2ee", "l5:helloi52e", "lli1ee",
+		"5", "5:abc", "-1:", ":", "1:",
+		"d3:fooe", "d5:hello", "l1:",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			if v, _, err := DecodeBencode([]byte(input)); err == nil {
+				t.Fatalf("decoded %#v without an error", v)
+			}
+		})
+	}
+}
+
+func TestRawValue(t *testing.T) {
+	dict := []byte("d4:infod6:lengthi3ee4:name1:xe")
+
+	raw, err := RawValue(dict, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "d6:lengthi3ee" {
+		t.Fatalf("raw value %q", raw)
+	}
+
+	for _, input := range []string{"d4:info", "d", "l4:infoe"} {
+		if _, err := RawValue([]byte(input), "info"); err == nil {
+			t.Fatalf("found info in %q", input)
+		}
+	}
+}
+
+func FuzzDecodeBencode(f *testing.F) {
+	for _, seed := range []string{"d", "l", "i", "i-e", "d1:a", "d3:foo3:bare", "l5:helloi52ee", "i52e"} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, rest, err := DecodeBencode(data)
+		if err != nil {
+			return
+		}
+		if len(rest) > len(data) {
+			t.Fatalf("rest of %d bytes from %d bytes of input", len(rest), len(data))
+		}
+		// whatever decodes encodes again
+		if _, err := Encode(v); err != nil {
+			t.Fatalf("decoded %#v, which doesn't encode: %v", v, err)
+		}
+	})
+}
@@ -0,0 +1,366 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+const (
+	// DEFAULT_PORT is the UDP port the DHT listens on unless told otherwise
+	DEFAULT_PORT = 6881
+	// QUERY_TIMEOUT is how long to wait for the reply to a query
+	QUERY_TIMEOUT = 3 * time.Second
+	// MAX_PACKET is the largest KRPC message we read
+	MAX_PACKET = 4096
+)
+
+// BOOTSTRAP_NODES are well known routers to join the mainline DHT through
+var BOOTSTRAP_NODES = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// KRPC query methods
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// DHT is a node of the mainline DHT (BEP 5). It answers queries from other nodes
+// as soon as it is created, and looks up and announces peers for info hashes
+type DHT struct {
+	ID    NodeID
+	Table *Table
+
+	conn   *net.UDPConn
+	tokens *tokens
+	peers  *peerStore
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	nextTid uint16
+	closed  bool
+	stats   Stats
+}
+
+// Stats counts the queries a node sent and answered
+type Stats struct {
+	// Sent and Received count queries per method
+	Sent     map[string]int
+	Received map[string]int
+	// Timeouts is how many queries went unanswered, Errors how many got an error back
+	Timeouts int
+	Errors   int
+}
+
+// Stats returns a copy of the query counts so far
+func (d *DHT) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := d.stats
+	stats.Sent = make(map[string]int, len(d.stats.Sent))
+	for method, n := range d.stats.Sent {
+		stats.Sent[method] = n
+	}
+	stats.Received = make(map[string]int, len(d.stats.Received))
+	for method, n := range d.stats.Received {
+		stats.Received[method] = n
+	}
+	return stats
+}
+
+// pendingQuery waits for the reply to a query we sent
+type pendingQuery struct {
+	addr  string
+	reply chan message
+}
+
+// New listens on addr, e.g. ":6881" or "127.0.0.1:0", as the node id.
+// The node knows nobody until Bootstrap is called or another node contacts it
+func New(addr string, id NodeID) (*DHT, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DHT{
+		ID:      id,
+		Table:   NewTable(id),
+		conn:    conn,
+		tokens:  newTokens(time.Now()),
+		peers:   newPeerStore(),
+		pending: make(map[string]*pendingQuery),
+		stats:   Stats{Sent: make(map[string]int), Received: make(map[string]int)},
+	}
+	go d.readLoop()
+	return d, nil
+}
+
+// Addr is the address the node listens on
+func (d *DHT) Addr() string {
+	return d.conn.LocalAddr().String()
+}
+
+// Close stops the node, queries in flight fail
+func (d *DHT) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	return d.conn.Close()
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, MAX_PACKET)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			d.mu.Lock()
+			closed := d.closed
+			d.mu.Unlock()
+			if closed {
+				return
+			}
+			util.DebugLog("DHT read failed: ", err)
+			continue
+		}
+
+		// decoded strings point into the packet, which has to outlive the next read
+		m, err := parseMessage(append([]byte{}, buf[:n]...))
+		if err != nil {
+			util.DebugLog("dropping packet from ", from, err)
+			continue
+		}
+		d.handle(m, from)
+	}
+}
+
+func (d *DHT) send(m message, addr *net.UDPAddr) error {
+	data, err := m.encode()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (d *DHT) handle(m message, from *net.UDPAddr) {
+	if m.Y != typeQuery {
+		d.mu.Lock()
+		q, ok := d.pending[m.T]
+		// a reply has to come from where the query went
+		if ok && q.addr == from.String() {
+			delete(d.pending, m.T)
+		}
+		d.mu.Unlock()
+
+		if ok && q.addr == from.String() {
+			q.reply <- m
+		} else {
+			util.DebugLog("dropping unexpected reply from ", from)
+		}
+		return
+	}
+
+	id, err := nodeID(m.A)
+	if err != nil {
+		d.sendError(m.T, ERROR_PROTOCOL, "missing id", from)
+		return
+	}
+	// unknown methods aren't counted, anyone could make up any number of them
+	switch m.Q {
+	case methodPing, methodFindNode, methodGetPeers, methodAnnouncePeer:
+		d.mu.Lock()
+		d.stats.Received[m.Q]++
+		d.mu.Unlock()
+	}
+
+	// nodes querying us are as alive as can be
+	d.Table.Seen(Node{ID: id, Addr: from.String()})
+
+	r, code, errMsg := d.answer(m, from)
+	if code != 0 {
+		d.sendError(m.T, code, errMsg, from)
+		return
+	}
+	r["id"] = d.ID[:]
+	if err := d.send(message{T: m.T, Y: typeResponse, R: r}, from); err != nil {
+		util.DebugLog("DHT reply failed: ", err)
+	}
+}
+
+func (d *DHT) sendError(tid string, code int, msg string, to *net.UDPAddr) {
+	d.send(message{T: tid, Y: typeError, E: []interface{}{code, msg}}, to)
+}
+
+// answer builds the response to a query, or an error code and message
+func (d *DHT) answer(m message, from *net.UDPAddr) (map[string]interface{}, int, string) {
+	now := time.Now()
+	switch m.Q {
+	case methodPing:
+		return map[string]interface{}{}, 0, ""
+
+	case methodFindNode:
+		target, err := IDFromBytes(bencode.Bytes(m.A["target"]))
+		if err != nil {
+			return nil, ERROR_PROTOCOL, "invalid target"
+		}
+		return map[string]interface{}{"nodes": encodeNodes(d.Table.Closest(target, K))}, 0, ""
+
+	case methodGetPeers:
+		infoHash, err := IDFromBytes(bencode.Bytes(m.A["info_hash"]))
+		if err != nil {
+			return nil, ERROR_PROTOCOL, "invalid info_hash"
+		}
+		r := map[string]interface{}{
+			"token": d.tokens.generate(from.IP, now),
+			"nodes": encodeNodes(d.Table.Closest(infoHash, K)),
+		}
+		if peers := d.peers.get(infoHash, now); len(peers) > 0 {
+			values := make([]interface{}, 0, len(peers))
+			for _, addr := range peers {
+				if compact, err := compactAddr(addr); err == nil {
+					values = append(values, compact)
+				}
+			}
+			r["values"] = values
+		}
+		return r, 0, ""
+
+	case methodAnnouncePeer:
+		infoHash, err := IDFromBytes(bencode.Bytes(m.A["info_hash"]))
+		if err != nil {
+			return nil, ERROR_PROTOCOL, "invalid info_hash"
+		}
+		if !d.tokens.valid(bencode.Bytes(m.A["token"]), from.IP, now) {
+			return nil, ERROR_PROTOCOL, "bad token"
+		}
+		port, _ := m.A["port"].(int)
+		// behind a NAT the port the packet came from is the one that works
+		if implied, _ := m.A["implied_port"].(int); implied != 0 {
+			port = from.Port
+		}
+		if port <= 0 || port > 65535 {
+			return nil, ERROR_PROTOCOL, "invalid port"
+		}
+		d.peers.add(infoHash, net.JoinHostPort(from.IP.String(), strconv.Itoa(port)), now)
+		return map[string]interface{}{}, 0, ""
+	}
+
+	return nil, ERROR_METHOD, "method unknown"
+}
+
+// query sends a query to addr and waits for the reply. The node answering is added to the routing table,
+// one that doesn't answer is marked as failed
+func (d *DHT) query(addr string, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, fmt.Errorf("DHT is closed")
+	}
+	d.nextTid++
+	tid := string(binary.BigEndian.AppendUint16(nil, d.nextTid))
+	q := &pendingQuery{addr: udpAddr.String(), reply: make(chan message, 1)}
+	d.pending[tid] = q
+	d.stats.Sent[method]++
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+	}()
+
+	args["id"] = d.ID[:]
+	if err := d.send(message{T: tid, Y: typeQuery, Q: method, A: args}, udpAddr); err != nil {
+		return nil, err
+	}
+
+	select {
+	case m := <-q.reply:
+		if m.Y == typeError {
+			d.mu.Lock()
+			d.stats.Errors++
+			d.mu.Unlock()
+			return nil, fmt.Errorf("%s from %s: %s", method, addr, errorString(m.E))
+		}
+		id, err := nodeID(m.R)
+		if err != nil {
+			return nil, fmt.Errorf("%s from %s: %v", method, addr, err)
+		}
+		d.Table.Seen(Node{ID: id, Addr: udpAddr.String()})
+		return m.R, nil
+	case <-time.After(QUERY_TIMEOUT):
+		d.Table.Failed(udpAddr.String())
+		d.mu.Lock()
+		d.stats.Timeouts++
+		d.mu.Unlock()
+		return nil, fmt.Errorf("%s to %s timed out", method, addr)
+	}
+}
+
+// Ping checks a node is alive, returning its id
+func (d *DHT) Ping(addr string) (NodeID, error) {
+	r, err := d.query(addr, methodPing, map[string]interface{}{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return nodeID(r)
+}
+
+// FindNode asks a node for the nodes it knows closest to target
+func (d *DHT) FindNode(addr string, target NodeID) ([]Node, error) {
+	r, err := d.query(addr, methodFindNode, map[string]interface{}{"target": target[:]})
+	if err != nil {
+		return nil, err
+	}
+	return decodeNodes(bencode.Bytes(r["nodes"]))
+}
+
+// GetPeers asks a node for peers of a torrent. Besides any peers it knows,
+// it returns the nodes closer to the info hash and the token needed to announce to it
+func (d *DHT) GetPeers(addr string, infoHash NodeID) ([]string, []Node, []byte, error) {
+	r, err := d.query(addr, methodGetPeers, map[string]interface{}{"info_hash": infoHash[:]})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nodes, err := decodeNodes(bencode.Bytes(r["nodes"]))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return decodeValues(r["values"]), nodes, bencode.Bytes(r["token"]), nil
+}
+
+// AnnouncePeer tells a node we are downloading a torrent on port, with the token from an earlier GetPeers.
+// A port of 0 asks the node to use the port our packets come from
+func (d *DHT) AnnouncePeer(addr string, infoHash NodeID, port int, token []byte) error {
+	args := map[string]interface{}{
+		"info_hash": infoHash[:],
+		"port":      port,
+		"token":     token,
+	}
+	if port == 0 {
+		args["implied_port"] = 1
+	}
+	_, err := d.query(addr, methodAnnouncePeer, args)
+	return err
+}
@@ -0,0 +1,216 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// network starts n nodes on loopback, all bootstrapped through the first
+func network(t *testing.T, n int) []*DHT {
+	t.Helper()
+
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		d, err := New("127.0.0.1:0", RandomID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		nodes[i] = d
+	}
+	for _, d := range nodes[1:] {
+		if err := d.Bootstrap([]string{nodes[0].Addr()}); err != nil {
+			t.Fatalf("bootstrap of %s: %v", d.Addr(), err)
+		}
+	}
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := network(t, 6)
+
+	// the first node was queried by everyone, the last one learnt of all the others on its lookup
+	if got := nodes[0].Table.Len(); got != len(nodes)-1 {
+		t.Fatalf("first node knows %d nodes, want %d", got, len(nodes)-1)
+	}
+	last := nodes[len(nodes)-1]
+	if got := last.Table.Len(); got != len(nodes)-1 {
+		t.Fatalf("last node knows %d nodes, want %d", got, len(nodes)-1)
+	}
+
+	closest, err := last.FindClosest(nodes[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) == 0 || closest[0].ID != nodes[1].ID {
+		t.Fatalf("lookup of %s did not find the node itself", nodes[1].ID)
+	}
+}
+
+func TestBootstrapNobodyAnswers(t *testing.T) {
+	d, err := New("127.0.0.1:0", RandomID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Bootstrap(nil); err == nil {
+		t.Fatal("bootstrap without nodes succeeded")
+	}
+	if _, err := d.Peers(RandomID()); err == nil {
+		t.Fatal("lookup with an empty routing table succeeded")
+	}
+}
+
+func TestMalformedPackets(t *testing.T) {
+	nodes := network(t, 2)
+
+	conn, err := net.Dial("udp4", nodes[0].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, packet := range []string{"d", "l", "i", "i-e", "d1:a", "d1:y1:q1:q4:pinge", "d1:t2:aa1:y1:re"} {
+		if _, err := conn.Write([]byte(packet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// still answering
+	if _, err := nodes[1].Ping(nodes[0].Addr()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := network(t, 5)
+	infoHash := RandomID()
+
+	peers, err := nodes[1].Announce(infoHash, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("found peers %v before anyone announced", peers)
+	}
+
+	// an implied port is the one the announce came from
+	if _, err := nodes[2].Announce(infoHash, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err = nodes[4].Peers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"127.0.0.1:4000": true, nodes[2].Addr(): true}
+	if len(peers) != len(want) {
+		t.Fatalf("found peers %v, want %v", peers, want)
+	}
+	for _, p := range peers {
+		if !want[p] {
+			t.Fatalf("found unexpected peer %s", p)
+		}
+	}
+
+	stats := nodes[1].Stats()
+	if stats.Sent[methodAnnouncePeer] == 0 || stats.Timeouts != 0 {
+		t.Fatalf("stats %+v, want announces sent and no timeouts", stats)
+	}
+}
+
+func TestAnnounceToken(t *testing.T) {
+	nodes := network(t, 3)
+	infoHash := RandomID()
+	addr := nodes[0].Addr()
+
+	_, _, token, err := nodes[1].GetPeers(addr, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) == 0 {
+		t.Fatal("get_peers returned no token")
+	}
+
+	err = nodes[1].AnnouncePeer(addr, infoHash, 4000, []byte("forged"))
+	if err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Fatalf("announce with a forged token: %v", err)
+	}
+
+	// tokens are tied to the IP, nodes on the same host share them
+	if err := nodes[2].AnnouncePeer(addr, infoHash, 4001, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].AnnouncePeer(addr, infoHash, 4000, token); err != nil {
+		t.Fatal(err)
+	}
+	peers, _, _, err := nodes[2].GetPeers(addr, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("found peers %v, want both announced", peers)
+	}
+	if nodes[0].Stats().Errors != 0 || nodes[1].Stats().Errors != 1 {
+		t.Fatal("the forged announce should be the only error")
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	nodes := network(t, 4)
+	d := nodes[3]
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	if err := d.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	state, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.ID != d.ID {
+		t.Fatalf("loaded id %s, want %s", state.ID, d.ID)
+	}
+	saved := d.Table.Nodes()
+	if len(state.Nodes) != len(saved) {
+		t.Fatalf("loaded %d nodes, want %d", len(state.Nodes), len(saved))
+	}
+	for i := range saved {
+		if state.Nodes[i] != saved[i] {
+			t.Fatalf("node %d is %v, want %v", i, state.Nodes[i], saved[i])
+		}
+	}
+
+	// a node coming back with the saved state joins through the nodes it knew
+	again, err := New("127.0.0.1:0", state.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if err := again.Bootstrap(state.Addrs()); err != nil {
+		t.Fatal(err)
+	}
+	if again.Table.Len() != len(saved) {
+		t.Fatalf("rejoined with %d nodes, want %d", again.Table.Len(), len(saved))
+	}
+}
+
+func TestLoadDamaged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	if _, err := Load(path); err == nil {
+		t.Fatal("loaded a missing file")
+	}
+
+	for _, content := range []string{"garbage", "d2:id3:abce", "d2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes3:abce"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Fatalf("loaded %q", content)
+		}
+	}
+}
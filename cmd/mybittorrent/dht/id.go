@@ -0,0 +1,65 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+// ID_LENGTH is the size of node ids and info hashes, which share one keyspace
+const ID_LENGTH = 20
+
+// NodeID identifies a node, distances between ids are their XOR
+type NodeID [ID_LENGTH]byte
+
+func RandomID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+// IDFromBytes takes a raw 20 byte id, like an info hash
+func IDFromBytes(b []byte) (NodeID, error) {
+	var id NodeID
+	if len(b) != ID_LENGTH {
+		return id, fmt.Errorf("id of %d bytes", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// ParseID reads a hex id
+func ParseID(s string) (NodeID, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return NodeID{}, fmt.Errorf("invalid id %q: %v", s, err)
+	}
+	return IDFromBytes(b)
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// closer reports whether a is closer to target than b
+func closer(target NodeID, a NodeID, b NodeID) bool {
+	for i := range target {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefix is the number of leading bits a and b share, ID_LENGTH*8 if they are equal
+func commonPrefix(a NodeID, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return ID_LENGTH * 8
+}
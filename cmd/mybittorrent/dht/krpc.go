@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// KRPC message types
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+)
+
+// KRPC error codes
+const (
+	ERROR_GENERIC  = 201
+	ERROR_SERVER   = 202
+	ERROR_PROTOCOL = 203
+	ERROR_METHOD   = 204
+)
+
+// COMPACT_NODE_LENGTH is a node id followed by a compact IPv4 address
+const COMPACT_NODE_LENGTH = ID_LENGTH + 6
+
+// message is a KRPC message, a bencoded dictionary sent in a single UDP packet
+type message struct {
+	// T is the transaction id, echoed back in the reply
+	T string
+	Y string
+	// Q is the method of a query, A its arguments
+	Q string
+	A map[string]interface{}
+	// R is the body of a response
+	R map[string]interface{}
+	// E is the code and message of an error
+	E []interface{}
+}
+
+func (m message) encode() ([]byte, error) {
+	dict := map[string]interface{}{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case typeQuery:
+		dict["q"] = m.Q
+		dict["a"] = m.A
+	case typeResponse:
+		dict["r"] = m.R
+	case typeError:
+		dict["e"] = m.E
+	}
+	return bencode.Encode(dict)
+}
+
+func parseMessage(data []byte) (message, error) {
+	decoded, _, err := bencode.DecodeBencode(data)
+	if err != nil {
+		return message{}, fmt.Errorf("invalid KRPC message: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return message{}, fmt.Errorf("KRPC message is not a dictionary")
+	}
+
+	m := message{T: string(bencode.Bytes(dict["t"])), Y: string(bencode.Bytes(dict["y"]))}
+	switch m.Y {
+	case typeQuery:
+		m.Q = string(bencode.Bytes(dict["q"]))
+		m.A, ok = dict["a"].(map[string]interface{})
+		if !ok {
+			return message{}, fmt.Errorf("query without arguments")
+		}
+	case typeResponse:
+		m.R, ok = dict["r"].(map[string]interface{})
+		if !ok {
+			return message{}, fmt.Errorf("response without body")
+		}
+	case typeError:
+		m.E, _ = dict["e"].([]interface{})
+	default:
+		return message{}, fmt.Errorf("unknown message type %q", m.Y)
+	}
+	return m, nil
+}
+
+// errorString describes the body of an error message
+func errorString(e []interface{}) string {
+	if len(e) != 2 {
+		return "malformed error"
+	}
+	code, _ := e[0].(int)
+	return fmt.Sprintf("error %d: %s", code, bencode.Bytes(e[1]))
+}
+
+// nodeID reads the id argument every query and response carries
+func nodeID(dict map[string]interface{}) (NodeID, error) {
+	return IDFromBytes(bencode.Bytes(dict["id"]))
+}
+
+// compactAddr packs an IPv4 ip:port into 6 bytes
+func compactAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host).To4()
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("not a compact IPv4 address: %q", addr)
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), uint16(port)), nil
+}
+
+func parseCompactAddr(b []byte) string {
+	port := binary.BigEndian.Uint16(b[4:6])
+	return net.JoinHostPort(net.IP(b[:4]).String(), strconv.Itoa(int(port)))
+}
+
+// encodeNodes is the compact node info of BEP 5, nodes without an IPv4 address are left out
+func encodeNodes(nodes []Node) []byte {
+	buf := make([]byte, 0, len(nodes)*COMPACT_NODE_LENGTH)
+	for _, n := range nodes {
+		addr, err := compactAddr(n.Addr)
+		if err != nil {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, addr...)
+	}
+	return buf
+}
+
+func decodeNodes(b []byte) ([]Node, error) {
+	if len(b)%COMPACT_NODE_LENGTH != 0 {
+		return nil, fmt.Errorf("compact nodes of %d bytes", len(b))
+	}
+
+	nodes := make([]Node, 0, len(b)/COMPACT_NODE_LENGTH)
+	for i := 0; i < len(b); i += COMPACT_NODE_LENGTH {
+		var n Node
+		copy(n.ID[:], b[i:i+ID_LENGTH])
+		n.Addr = parseCompactAddr(b[i+ID_LENGTH : i+COMPACT_NODE_LENGTH])
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// decodeValues reads the peers of a get_peers response, a list of compact addresses
+func decodeValues(v interface{}) []string {
+	values, _ := v.([]interface{})
+	peers := make([]string, 0, len(values))
+	for _, value := range values {
+		if b := bencode.Bytes(value); len(b) == 6 {
+			peers = append(peers, parseCompactAddr(b))
+		}
+	}
+	return peers
+}
@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// ALPHA is how many queries a lookup keeps in flight
+const ALPHA = 3
+
+// candidate is a node met during a lookup
+type candidate struct {
+	Node
+	queried   bool
+	responded bool
+	// token from get_peers, needed to announce to the node
+	token []byte
+}
+
+// lookup is the iterative Kademlia search: keep querying the closest nodes not asked yet,
+// ALPHA at a time, until the K closest that answered have all been asked.
+// With getPeers it also collects the peers found on the way.
+// Returns the K closest nodes that answered, closest first
+func (d *DHT) lookup(target NodeID, getPeers bool) ([]*candidate, []string, error) {
+	start := d.Table.Closest(target, K)
+	if len(start) == 0 {
+		return nil, nil, fmt.Errorf("routing table is empty, bootstrap first")
+	}
+
+	var mu sync.Mutex
+	seen := make(map[NodeID]bool)
+	var shortlist []*candidate
+	add := func(nodes []Node) {
+		for _, n := range nodes {
+			if n.ID == d.ID || seen[n.ID] {
+				continue
+			}
+			seen[n.ID] = true
+			shortlist = append(shortlist, &candidate{Node: n})
+		}
+		sort.Slice(shortlist, func(i, j int) bool { return closer(target, shortlist[i].ID, shortlist[j].ID) })
+	}
+	add(start)
+
+	peerSeen := make(map[string]bool)
+	var peers []string
+
+	for {
+		mu.Lock()
+		// the next round goes to the closest nodes not asked yet, as long as they could make the top K
+		var round []*candidate
+		answered := 0
+		for _, c := range shortlist {
+			if answered >= K || len(round) >= ALPHA {
+				break
+			}
+			if !c.queried {
+				c.queried = true
+				round = append(round, c)
+			} else if c.responded {
+				answered++
+			}
+		}
+		mu.Unlock()
+		if len(round) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range round {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+
+				var found []string
+				var nodes []Node
+				var token []byte
+				var err error
+				if getPeers {
+					found, nodes, token, err = d.GetPeers(c.Addr, target)
+				} else {
+					nodes, err = d.FindNode(c.Addr, target)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					return
+				}
+				c.responded = true
+				c.token = token
+				for _, p := range found {
+					if !peerSeen[p] {
+						peerSeen[p] = true
+						peers = append(peers, p)
+					}
+				}
+				add(nodes)
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	var closest []*candidate
+	for _, c := range shortlist {
+		if c.responded && len(closest) < K {
+			closest = append(closest, c)
+		}
+	}
+	return closest, peers, nil
+}
+
+// Bootstrap joins the DHT through the given nodes, e.g. BOOTSTRAP_NODES or those saved from an earlier run,
+// then looks up our own id to fill the routing table with our neighbourhood
+func (d *DHT) Bootstrap(addrs []string) error {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if _, err := d.Ping(addr); err != nil {
+				util.DebugLog("bootstrap node failed: ", addr, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if d.Table.Len() == 0 {
+		return fmt.Errorf("no bootstrap node answered")
+	}
+	_, _, err := d.lookup(d.ID, false)
+	return err
+}
+
+// FindClosest looks up the K nodes closest to target
+func (d *DHT) FindClosest(target NodeID) ([]Node, error) {
+	closest, _, err := d.lookup(target, false)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, len(closest))
+	for i, c := range closest {
+		nodes[i] = c.Node
+	}
+	return nodes, nil
+}
+
+// Peers looks up peers of a torrent
+func (d *DHT) Peers(infoHash NodeID) ([]string, error) {
+	_, peers, err := d.lookup(infoHash, true)
+	return peers, err
+}
+
+// Announce looks up peers of a torrent and tells the K closest nodes we have it on port,
+// 0 meaning the port our packets come from. Returns the peers found
+func (d *DHT) Announce(infoHash NodeID, port int) ([]string, error) {
+	closest, peers, err := d.lookup(infoHash, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			if err := d.AnnouncePeer(c.Addr, infoHash, port, c.token); err != nil {
+				util.DebugLog("announce failed: ", c.Addr, err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	return peers, nil
+}
@@ -0,0 +1,65 @@
+package dht
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// State is what a node keeps between runs: its id, so it stays in the same place of the keyspace,
+// and the nodes of its routing table to bootstrap from
+type State struct {
+	ID    NodeID
+	Nodes []Node
+}
+
+// Addrs lists the addresses of the saved nodes, for Bootstrap
+func (s State) Addrs() []string {
+	addrs := make([]string, len(s.Nodes))
+	for i, n := range s.Nodes {
+		addrs[i] = n.Addr
+	}
+	return addrs
+}
+
+// Save writes the node id and the good nodes of the routing table to path
+func (d *DHT) Save(path string) error {
+	content, err := bencode.Encode(map[string]interface{}{
+		"id":    d.ID[:],
+		"nodes": encodeNodes(d.Table.Nodes()),
+	})
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(path, content)
+}
+
+// Load reads the state written by Save
+func Load(path string) (State, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return State{}, err
+	}
+
+	decoded, _, err := bencode.DecodeBencode(content)
+	if err != nil {
+		return State{}, fmt.Errorf("damaged DHT state: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return State{}, fmt.Errorf("damaged DHT state")
+	}
+
+	id, err := nodeID(dict)
+	if err != nil {
+		return State{}, fmt.Errorf("damaged DHT state: %v", err)
+	}
+	nodes, err := decodeNodes(bencode.Bytes(dict["nodes"]))
+	if err != nil {
+		return State{}, fmt.Errorf("damaged DHT state: %v", err)
+	}
+	return State{ID: id, Nodes: nodes}, nil
+}
@@ -0,0 +1,159 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// TOKEN_ROTATION is how often the token secret changes, tokens stay valid for two rotations
+	TOKEN_ROTATION = 5 * time.Minute
+	// PEER_TTL is how long an announced peer is handed out without announcing again
+	PEER_TTL = 30 * time.Minute
+	// MAX_VALUES caps the peers returned for one get_peers query, so the reply fits a packet
+	MAX_VALUES = 50
+	// MAX_PEERS_PER_HASH caps the peers kept for one info hash, the oldest announce makes room for a new one
+	MAX_PEERS_PER_HASH = 2 * MAX_VALUES
+	// MAX_STORED_PEERS caps the peers kept over all info hashes, announces beyond it are dropped
+	MAX_STORED_PEERS = 5000
+)
+
+// tokens hands out the tokens get_peers returns, an announce_peer is only accepted with a token
+// given to the same IP recently. Tokens are derived from the IP and a rotating secret, nothing is stored per node
+type tokens struct {
+	mu       sync.Mutex
+	secret   [8]byte
+	previous [8]byte
+	rotated  time.Time
+}
+
+func newTokens(now time.Time) *tokens {
+	t := &tokens{rotated: now}
+	rand.Read(t.secret[:])
+	t.previous = t.secret
+	return t
+}
+
+// rotate changes the secret once TOKEN_ROTATION passed; caller holds t.mu
+func (t *tokens) rotate(now time.Time) {
+	if now.Sub(t.rotated) < TOKEN_ROTATION {
+		return
+	}
+	t.previous = t.secret
+	rand.Read(t.secret[:])
+	t.rotated = now
+}
+
+func tokenFor(secret [8]byte, ip net.IP) []byte {
+	h := sha1.New()
+	h.Write(ip.To16())
+	h.Write(secret[:])
+	return h.Sum(nil)[:8]
+}
+
+func (t *tokens) generate(ip net.IP, now time.Time) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate(now)
+	return tokenFor(t.secret, ip)
+}
+
+func (t *tokens) valid(token []byte, ip net.IP, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate(now)
+	return subtle.ConstantTimeCompare(token, tokenFor(t.secret, ip)) == 1 ||
+		subtle.ConstantTimeCompare(token, tokenFor(t.previous, ip)) == 1
+}
+
+// peerStore keeps the peers announced to us, per info hash
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[NodeID]map[string]time.Time
+	// peers over all info hashes
+	total int
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[NodeID]map[string]time.Time)}
+}
+
+// add records an announce. A torrent with MAX_PEERS_PER_HASH peers forgets its oldest one,
+// and nothing new is taken while MAX_STORED_PEERS are stored, so no torrent pushes out the others
+func (s *peerStore) add(infoHash NodeID, addr string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := s.peers[infoHash]
+	if _, ok := peers[addr]; ok {
+		peers[addr] = now
+		return
+	}
+
+	if s.total >= MAX_STORED_PEERS {
+		s.expire(now)
+		if s.total >= MAX_STORED_PEERS {
+			return
+		}
+	}
+
+	if peers == nil {
+		peers = make(map[string]time.Time)
+		s.peers[infoHash] = peers
+	}
+	if len(peers) >= MAX_PEERS_PER_HASH {
+		oldest := ""
+		for other, announced := range peers {
+			if oldest == "" || announced.Before(peers[oldest]) {
+				oldest = other
+			}
+		}
+		delete(peers, oldest)
+		s.total--
+	}
+	peers[addr] = now
+	s.total++
+}
+
+// expire drops every peer that didn't announce within PEER_TTL; caller holds s.mu
+func (s *peerStore) expire(now time.Time) {
+	for infoHash, peers := range s.peers {
+		for addr, announced := range peers {
+			if now.Sub(announced) > PEER_TTL {
+				delete(peers, addr)
+				s.total--
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
+
+// get returns up to MAX_VALUES peers of a torrent, dropping those that expired
+func (s *peerStore) get(infoHash NodeID, now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var peers []string
+	for addr, announced := range s.peers[infoHash] {
+		if now.Sub(announced) > PEER_TTL {
+			delete(s.peers[infoHash], addr)
+			s.total--
+			continue
+		}
+		if len(peers) < MAX_VALUES {
+			peers = append(peers, addr)
+		}
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+	return peers
+}
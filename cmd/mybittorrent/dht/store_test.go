@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// peerAddr makes up the address of the i-th peer announcing
+func peerAddr(i int) string {
+	return fmt.Sprintf("10.%d.%d.%d:6881", i>>16&0xff, i>>8&0xff, i&0xff)
+}
+
+func TestPeerStorePerHashCap(t *testing.T) {
+	s := newPeerStore()
+	infoHash := RandomID()
+	now := time.Now()
+
+	for i := 0; i < MAX_PEERS_PER_HASH+10; i++ {
+		s.add(infoHash, peerAddr(i), now.Add(time.Duration(i)*time.Second))
+	}
+	if got := len(s.peers[infoHash]); got != MAX_PEERS_PER_HASH {
+		t.Fatalf("%d peers kept, want %d", got, MAX_PEERS_PER_HASH)
+	}
+	// the oldest ones made room
+	for i := 0; i < 10; i++ {
+		if _, ok := s.peers[infoHash][peerAddr(i)]; ok {
+			t.Fatalf("peer %d is still there", i)
+		}
+	}
+	if s.total != MAX_PEERS_PER_HASH {
+		t.Fatalf("total of %d, want %d", s.total, MAX_PEERS_PER_HASH)
+	}
+
+	// announcing again just refreshes the peer
+	s.add(infoHash, peerAddr(10), now.Add(time.Hour))
+	if _, ok := s.peers[infoHash][peerAddr(10)]; !ok || s.total != MAX_PEERS_PER_HASH {
+		t.Fatal("announcing again changed the peers kept")
+	}
+	if got := len(s.get(infoHash, now.Add(time.Hour))); got != 1 {
+		t.Fatalf("%d peers left after the others expired, want 1", got)
+	}
+	if s.total != 1 {
+		t.Fatalf("total of %d after expiring, want 1", s.total)
+	}
+}
+
+func TestPeerStoreTotalCap(t *testing.T) {
+	s := newPeerStore()
+	now := time.Now()
+
+	hashes := MAX_STORED_PEERS / MAX_PEERS_PER_HASH
+	for h := 0; h < hashes; h++ {
+		infoHash := idAt(h, 1)
+		for i := 0; i < MAX_PEERS_PER_HASH; i++ {
+			s.add(infoHash, peerAddr(i), now)
+		}
+	}
+	if s.total != MAX_STORED_PEERS {
+		t.Fatalf("total of %d, want %d", s.total, MAX_STORED_PEERS)
+	}
+
+	// a full store doesn't take another torrent, nor push out peers of the others
+	other := idAt(hashes, 1)
+	s.add(other, peerAddr(0), now)
+	s.add(idAt(0, 1), peerAddr(MAX_PEERS_PER_HASH), now)
+	if len(s.peers[other]) != 0 || s.total != MAX_STORED_PEERS {
+		t.Fatal("full store took another peer")
+	}
+	if _, ok := s.peers[idAt(0, 1)][peerAddr(0)]; !ok {
+		t.Fatal("full store pushed out a peer")
+	}
+
+	// once they expired there is room again
+	later := now.Add(PEER_TTL + time.Minute)
+	s.add(other, peerAddr(0), later)
+	if got := s.get(other, later); len(got) != 1 || s.total != 1 {
+		t.Fatalf("got %v with a total of %d after the others expired", got, s.total)
+	}
+}
@@ -0,0 +1,157 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	// K is the bucket size and how many nodes a lookup converges on
+	K = 8
+	// MAX_FAILURES is how many queries in a row a node may miss before it is replaced
+	MAX_FAILURES = 3
+)
+
+// Node is another DHT node, Addr is ip:port
+type Node struct {
+	ID   NodeID
+	Addr string
+}
+
+type tableEntry struct {
+	Node
+	failures int
+}
+
+func (e *tableEntry) bad() bool {
+	return e.failures >= MAX_FAILURES
+}
+
+// Table is the Kademlia routing table. Bucket i holds the nodes whose ids share exactly i leading bits
+// with ours, so there are many more nodes known close to us than far away.
+// Each bucket is ordered from least to most recently seen
+type Table struct {
+	self NodeID
+
+	mu      sync.Mutex
+	buckets [ID_LENGTH * 8][]*tableEntry
+}
+
+func NewTable(self NodeID) *Table {
+	return &Table{self: self}
+}
+
+// bucket is the index of the bucket id belongs in, -1 for our own id
+func (t *Table) bucket(id NodeID) int {
+	prefix := commonPrefix(t.self, id)
+	if prefix == ID_LENGTH*8 {
+		return -1
+	}
+	return prefix
+}
+
+// Seen records a node we heard from. A full bucket only takes it in place of a bad node,
+// long lived nodes are the ones most likely to stay. Reports whether the node is in the table
+func (t *Table) Seen(n Node) bool {
+	index := t.bucket(n.ID)
+	if index < 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.buckets[index]
+	for i, e := range b {
+		if e.ID != n.ID {
+			continue
+		}
+		e.Addr = n.Addr
+		e.failures = 0
+		// move to the back, the most recently seen
+		t.buckets[index] = append(append(b[:i:i], b[i+1:]...), e)
+		return true
+	}
+
+	entry := &tableEntry{Node: n}
+	if len(b) < K {
+		t.buckets[index] = append(b, entry)
+		return true
+	}
+	for i, e := range b {
+		if e.bad() {
+			t.buckets[index] = append(append(b[:i:i], b[i+1:]...), entry)
+			return true
+		}
+	}
+	return false
+}
+
+// Failed records a query to the node at addr that went unanswered
+func (t *Table) Failed(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, b := range t.buckets {
+		for _, e := range b {
+			if e.Addr == addr {
+				e.failures++
+			}
+		}
+	}
+}
+
+// Closest returns up to n good nodes closest to target
+func (t *Table) Closest(target NodeID, n int) []Node {
+	t.mu.Lock()
+	var nodes []Node
+	for _, b := range t.buckets {
+		for _, e := range b {
+			if !e.bad() {
+				nodes = append(nodes, e.Node)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return closer(target, nodes[i].ID, nodes[j].ID) })
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// Nodes lists every good node in the table
+func (t *Table) Nodes() []Node {
+	return t.Closest(t.self, ID_LENGTH*8*K)
+}
+
+// Len is the number of nodes in the table, good or not
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return n
+}
+
+// Buckets returns how many nodes each bucket holds, up to the last one in use
+func (t *Table) Buckets() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last := -1
+	for i, b := range t.buckets {
+		if len(b) > 0 {
+			last = i
+		}
+	}
+	sizes := make([]int, last+1)
+	for i := range sizes {
+		sizes[i] = len(t.buckets[i])
+	}
+	return sizes
+}
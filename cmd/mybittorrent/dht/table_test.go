@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+)
+
+// idAt returns an id sharing exactly prefix leading bits with the zero id, n tells apart ids of the same bucket
+func idAt(prefix int, n byte) NodeID {
+	var id NodeID
+	id[prefix/8] = 0x80 >> (prefix % 8)
+	id[ID_LENGTH-1] |= n
+	return id
+}
+
+func node(id NodeID) Node {
+	return Node{ID: id, Addr: fmt.Sprintf("10.0.0.%d:6881", id[ID_LENGTH-1])}
+}
+
+func TestTableBuckets(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []int
+		want     []int
+	}{
+		{
+			name:     "one node per bucket",
+			prefixes: []int{0, 1, 3},
+			want:     []int{1, 1, 0, 1},
+		},
+		{
+			name:     "nodes close to us go deep",
+			prefixes: []int{0, 0, 100, 100, 100},
+			want:     append(append([]int{2}, make([]int, 99)...), 3),
+		},
+		{
+			name:     "empty table",
+			prefixes: nil,
+			want:     []int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewTable(NodeID{})
+			for i, prefix := range tt.prefixes {
+				if !table.Seen(node(idAt(prefix, byte(i+1)))) {
+					t.Fatalf("node %d with prefix %d not taken", i, prefix)
+				}
+			}
+
+			got := table.Buckets()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d buckets, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("bucket %d holds %d nodes, want %d", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTableFullBucket(t *testing.T) {
+	table := NewTable(NodeID{})
+	if table.Seen(node(NodeID{})) {
+		t.Fatal("took our own id")
+	}
+
+	for i := 1; i <= K; i++ {
+		table.Seen(node(idAt(0, byte(i))))
+	}
+	newcomer := node(idAt(0, K+1))
+	if table.Seen(newcomer) {
+		t.Fatal("full bucket took another node")
+	}
+
+	// seeing a known node again doesn't need room
+	if !table.Seen(node(idAt(0, 1))) {
+		t.Fatal("known node not taken back")
+	}
+
+	// a node that stopped answering makes room
+	bad := node(idAt(0, 2))
+	for i := 0; i < MAX_FAILURES; i++ {
+		table.Failed(bad.Addr)
+	}
+	if !table.Seen(newcomer) {
+		t.Fatal("newcomer not taken in place of a bad node")
+	}
+	if table.Len() != K {
+		t.Fatalf("table holds %d nodes, want %d", table.Len(), K)
+	}
+	for _, n := range table.Nodes() {
+		if n.ID == bad.ID {
+			t.Fatal("bad node still in the table")
+		}
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	table := NewTable(NodeID{})
+	for prefix := 0; prefix < 10; prefix++ {
+		table.Seen(node(idAt(prefix, byte(prefix+1))))
+	}
+	// one that doesn't answer is left out
+	for i := 0; i < MAX_FAILURES; i++ {
+		table.Failed(node(idAt(9, 10)).Addr)
+	}
+
+	target := idAt(9, 0)
+	closest := table.Closest(target, 3)
+	want := []NodeID{idAt(8, 9), idAt(7, 8), idAt(6, 7)}
+	if len(closest) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(closest), len(want))
+	}
+	for i := range want {
+		if closest[i].ID != want[i] {
+			t.Fatalf("node %d is %s, want %s", i, closest[i].ID, want[i])
+		}
+	}
+}
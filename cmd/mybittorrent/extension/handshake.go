@@ -0,0 +1,119 @@
+package extension
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+)
+
+// EXTENDED_HANDSHAKE_ID is the extended message id of the BEP 10 handshake itself
+const EXTENDED_HANDSHAKE_ID = 0
+
+// ExtendedHandshake is the dictionary exchanged right after the regular handshake
+type ExtendedHandshake struct {
+	// M maps extension names to the message ids the sender wants to receive them as
+	M map[string]int
+	// MetadataSize is the size of the info dictionary in bytes (BEP 9), 0 if not given
+	MetadataSize int
+	// V is the client name and version
+	V string
+	// Reqq is how many outstanding requests the sender accepts, 0 if not given
+	Reqq int
+	// YourIP is our address as the sender sees it, nil if not given
+	YourIP net.IP
+	// Port is where the sender listens for incoming connections, 0 if not given
+	Port int
+	// Dict is the whole decoded dictionary, for keys only some extensions care about
+	Dict map[string]interface{}
+}
+
+// Client splits V into the client name and its version, the version is empty if V has none
+func (h ExtendedHandshake) Client() (string, string) {
+	i := strings.LastIndex(h.V, " ")
+	if i < 0 {
+		return h.V, ""
+	}
+	return h.V[:i], h.V[i+1:]
+}
+
+// NewExtendedMessage wraps an extension's payload, id is the one the receiving peer assigned
+func NewExtendedMessage(id int, payload []byte) protocol.Message {
+	return protocol.Message{Id: protocol.MsgExtended, Payload: append([]byte{byte(id)}, payload...)}
+}
+
+func NewExtendedHandshakeMessage(h ExtendedHandshake) (protocol.Message, error) {
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = id
+	}
+
+	dict := map[string]interface{}{"m": m}
+	if h.MetadataSize > 0 {
+		dict["metadata_size"] = h.MetadataSize
+	}
+	if h.V != "" {
+		dict["v"] = h.V
+	}
+	if h.Reqq > 0 {
+		dict["reqq"] = h.Reqq
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = []byte(ip4)
+	} else if h.YourIP != nil {
+		dict["yourip"] = []byte(h.YourIP.To16())
+	}
+	if h.Port > 0 {
+		dict["p"] = h.Port
+	}
+
+	payload, err := bencode.Encode(dict)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	return NewExtendedMessage(EXTENDED_HANDSHAKE_ID, payload), nil
+}
+
+// ParseExtendedHandshake reads the dictionary of an extended handshake, without its message id
+func ParseExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	if len(payload) == 0 {
+		return ExtendedHandshake{}, fmt.Errorf("empty extended handshake")
+	}
+	decoded, _, err := bencode.DecodeBencode(payload)
+	if err != nil {
+		return ExtendedHandshake{}, fmt.Errorf("invalid extended handshake: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return ExtendedHandshake{}, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	h := ExtendedHandshake{M: make(map[string]int), Dict: dict}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			// an id of 0 means the extension is disabled
+			if id, ok := id.(int); ok && id > 0 && id <= 255 {
+				h.M[name] = id
+			}
+		}
+	}
+	if size, ok := dict["metadata_size"].(int); ok {
+		h.MetadataSize = size
+	}
+	if v, ok := dict["v"].(string); ok {
+		h.V = v
+	}
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		h.Reqq = reqq
+	}
+	// compact, 4 bytes for IPv4 and 16 for IPv6
+	if ip := bencode.Bytes(dict["yourip"]); len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		h.YourIP = net.IP(ip)
+	}
+	if port, ok := dict["p"].(int); ok && port > 0 && port <= 65535 {
+		h.Port = port
+	}
+	return h, nil
+}
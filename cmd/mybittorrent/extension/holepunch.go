@@ -0,0 +1,91 @@
+package extension
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ut_holepunch message types (BEP 55)
+const (
+	// HOLEPUNCH_RENDEZVOUS asks the receiver to relay a connect to the target, both being connected to it
+	HOLEPUNCH_RENDEZVOUS = 0x00
+	// HOLEPUNCH_CONNECT tells the receiver to connect to the address, the other side does the same
+	HOLEPUNCH_CONNECT = 0x01
+	// HOLEPUNCH_ERROR answers a rendezvous that couldn't be relayed
+	HOLEPUNCH_ERROR = 0x02
+)
+
+// ut_holepunch error codes
+const (
+	HOLEPUNCH_NO_SUCH_PEER  = 0x01
+	HOLEPUNCH_NOT_CONNECTED = 0x02
+	HOLEPUNCH_NO_SUPPORT    = 0x03
+	HOLEPUNCH_NO_SELF       = 0x04
+)
+
+// address types of a ut_holepunch message
+const (
+	holepunchIPv4 = 0x00
+	holepunchIPv6 = 0x01
+)
+
+// HolepunchMessage is one ut_holepunch message, Addr is ip:port. ErrCode is only set for HOLEPUNCH_ERROR
+type HolepunchMessage struct {
+	Type    byte
+	Addr    string
+	ErrCode uint32
+}
+
+// Encode packs the message as msg_type, addr_type, addr, port and err_code
+func (m HolepunchMessage) Encode() ([]byte, error) {
+	compact, ipv6, err := compactAddr(m.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrType := byte(holepunchIPv4)
+	if ipv6 {
+		addrType = holepunchIPv6
+	}
+	payload := append([]byte{m.Type, addrType}, compact...)
+	return binary.BigEndian.AppendUint32(payload, m.ErrCode), nil
+}
+
+// ParseHolepunch reads a ut_holepunch payload, failing on message and address types BEP 55 doesn't define
+func ParseHolepunch(payload []byte) (HolepunchMessage, error) {
+	if len(payload) < 2 {
+		return HolepunchMessage{}, fmt.Errorf("ut_holepunch message of %d bytes", len(payload))
+	}
+
+	m := HolepunchMessage{Type: payload[0]}
+	if m.Type > HOLEPUNCH_ERROR {
+		return HolepunchMessage{}, fmt.Errorf("unsupported ut_holepunch message type %d", m.Type)
+	}
+
+	ipLen := net.IPv4len
+	switch payload[1] {
+	case holepunchIPv4:
+	case holepunchIPv6:
+		ipLen = net.IPv6len
+	default:
+		return HolepunchMessage{}, fmt.Errorf("unsupported ut_holepunch address type %d", payload[1])
+	}
+
+	// the address, the port and the error code
+	body := payload[2:]
+	if len(body) != ipLen+2+4 {
+		return HolepunchMessage{}, fmt.Errorf("ut_holepunch message of %d bytes", len(payload))
+	}
+	port := binary.BigEndian.Uint16(body[ipLen:])
+	if port == 0 {
+		return HolepunchMessage{}, fmt.Errorf("ut_holepunch address without a port")
+	}
+	m.Addr = net.JoinHostPort(net.IP(body[:ipLen]).String(), strconv.Itoa(int(port)))
+	m.ErrCode = binary.BigEndian.Uint32(body[ipLen+2:])
+	if m.Type == HOLEPUNCH_ERROR && m.ErrCode == 0 {
+		return HolepunchMessage{}, fmt.Errorf("ut_holepunch error without a code")
+	}
+	return m, nil
+}
@@ -0,0 +1,51 @@
+package extension
+
+import (
+	"testing"
+)
+
+func TestHolepunchRoundTrip(t *testing.T) {
+	messages := []HolepunchMessage{
+		{Type: HOLEPUNCH_RENDEZVOUS, Addr: "10.0.0.1:6881"},
+		{Type: HOLEPUNCH_CONNECT, Addr: "[2001:db8::1]:51413"},
+		{Type: HOLEPUNCH_ERROR, Addr: "10.0.0.1:6881", ErrCode: HOLEPUNCH_NO_SUPPORT},
+	}
+
+	for _, m := range messages {
+		payload, err := m.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseHolepunch(payload)
+		if err != nil {
+			t.Fatalf("%+v: %v", m, err)
+		}
+		if got != m {
+			t.Fatalf("parsed %+v, want %+v", got, m)
+		}
+	}
+}
+
+func TestParseHolepunchMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"empty", ""},
+		{"no address", "\x00\x00"},
+		{"unknown message type", "\x03\x00\x0a\x00\x00\x01\x1a\xe1\x00\x00\x00\x00"},
+		{"unknown address type", "\x00\x02\x0a\x00\x00\x01\x1a\xe1\x00\x00\x00\x00"},
+		{"IPv6 type with an IPv4 address", "\x00\x01\x0a\x00\x00\x01\x1a\xe1\x00\x00\x00\x00"},
+		{"no error code", "\x01\x00\x0a\x00\x00\x01\x1a\xe1"},
+		{"no port", "\x01\x00\x0a\x00\x00\x01\x00\x00\x00\x00\x00\x00"},
+		{"error without a code", "\x02\x00\x0a\x00\x00\x01\x1a\xe1\x00\x00\x00\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if m, err := ParseHolepunch([]byte(tt.payload)); err == nil {
+				t.Fatalf("parsed %+v", m)
+			}
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package extension
 
 import (
+	"encoding/base32"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
@@ -13,45 +16,262 @@ import (
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
 )
 
+// UNKNOWN_LEFT is what we tell trackers is left to download when the link has no xl.
+// Anything but 0, which would have us announced as a seed
+const UNKNOWN_LEFT = 16 * 1024
+
 type Magnet struct {
-	link            string
-	URL             string
+	link string
+	// URL is the first tracker, kept for the commands that only use one
+	URL      string
+	Trackers []string
+	// InfoHash is the hex v1 info hash
 	InfoHash        string
 	InfoHashDecoded []byte
+	// V2Hash is the sha256 info hash of a v2 or hybrid torrent, if the link has one
+	V2Hash []byte
+	// Name is the suggested display name
+	Name string
+	// Length is the exact length in bytes, -1 when unknown
+	Length int64
+	// WebSeeds are HTTP sources for the payload
+	WebSeeds []string
+	// Peers are addresses to connect to directly, without a tracker
+	Peers []string
+	// Select lists the ranges of file indices to download (BEP 53), nil means everything
+	Select []FileRange
+}
+
+// FileRange is an inclusive range of file indices. Kept as a range, as the link may ask
+// for far more files than the torrent turns out to have
+type FileRange struct {
+	First int
+	Last  int
 }
 
 func NewMagnet(link string) *Magnet {
-	return &Magnet{link: link}
+	return &Magnet{link: link, Length: -1}
 }
 
+// Parse validates the link and fills in the fields, parameters may come in any order
 func (m *Magnet) Parse() error {
-	if afterStr, found := strings.CutPrefix(m.link, "magnet:?xt=urn:btih:"); found {
-		parts := strings.Split(afterStr, "&")
+	u, err := url.Parse(m.link)
+	if err != nil {
+		return fmt.Errorf("invalid magnet link: %v", err)
+	}
+	if u.Scheme != "magnet" {
+		return fmt.Errorf("invalid magnet link: scheme %q", u.Scheme)
+	}
+
+	// split by hand rather than with url.ParseQuery, which loses the order of the trackers
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return fmt.Errorf("invalid magnet link: %v", err)
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return fmt.Errorf("invalid magnet link: %v", err)
+		}
 
-		urls := strings.Split(parts[2], "=")
-		decodedURL, err := url.QueryUnescape(urls[1])
+		// xt, tr and so on may also be numbered, as in xt.1
+		name := key
+		if dot := strings.LastIndex(key, "."); dot != -1 && key != "x.pe" {
+			if _, err := strconv.Atoi(key[dot+1:]); err == nil {
+				name = key[:dot]
+			}
+		}
+
+		err = m.parseParam(name, value)
 		if err != nil {
 			return err
 		}
+	}
+
+	if m.InfoHashDecoded == nil && m.V2Hash == nil {
+		return fmt.Errorf("invalid magnet link: no urn:btih or urn:btmh exact topic")
+	}
+	// peers, trackers and the DHT are all asked by the v1 info hash
+	if m.InfoHashDecoded == nil {
+		return fmt.Errorf("v2 only magnet links are not supported, a urn:btih exact topic is needed")
+	}
+
+	if len(m.Trackers) > 0 {
+		m.URL = m.Trackers[0]
+	}
+	return nil
+}
 
-		m.URL = decodedURL
-		m.InfoHash = parts[0]
-		infoHashDecoded, err := hex.DecodeString(m.InfoHash)
+func (m *Magnet) parseParam(name string, value string) error {
+	switch name {
+	case "xt":
+		return m.parseExactTopic(value)
+	case "tr":
+		m.Trackers = append(m.Trackers, value)
+	case "dn":
+		m.Name = value
+	case "xl":
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("invalid magnet link: bad exact length %q", value)
+		}
+		m.Length = length
+	case "ws":
+		m.WebSeeds = append(m.WebSeeds, value)
+	case "x.pe":
+		host, port, err := net.SplitHostPort(value)
+		if err != nil || host == "" {
+			return fmt.Errorf("invalid magnet link: bad peer address %q", value)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid magnet link: bad peer port %q", value)
+		}
+		m.Peers = append(m.Peers, value)
+	case "so":
+		ranges, err := parseSelectOnly(value)
 		if err != nil {
 			return err
 		}
+		m.Select = append(m.Select, ranges...)
+	default:
+		util.DebugLog("ignoring magnet parameter ", name)
+	}
+	return nil
+}
+
+func (m *Magnet) parseExactTopic(value string) error {
+	if hash, found := strings.CutPrefix(value, "urn:btih:"); found {
+		var decoded []byte
+		var err error
+		switch len(hash) {
+		case 40:
+			decoded, err = hex.DecodeString(hash)
+		case 32:
+			decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("length %d", len(hash))
+		}
+		if err != nil {
+			return fmt.Errorf("invalid magnet link: bad btih info hash %q: %v", hash, err)
+		}
+		// the same hash twice, hex and base32 say, is fine, two torrents in one link aren't
+		if m.InfoHashDecoded != nil && string(m.InfoHashDecoded) != string(decoded) {
+			return fmt.Errorf("invalid magnet link: more than one btih info hash")
+		}
+
+		m.InfoHashDecoded = decoded
+		m.InfoHash = hex.EncodeToString(decoded)
+		return nil
+	}
 
-		m.InfoHashDecoded = infoHashDecoded
+	if hash, found := strings.CutPrefix(value, "urn:btmh:"); found {
+		// a multihash, v2 torrents use sha2-256: 0x12, then the digest length 0x20
+		decoded, err := hex.DecodeString(hash)
+		if err != nil || len(decoded) != 34 || decoded[0] != 0x12 || decoded[1] != 0x20 {
+			return fmt.Errorf("invalid magnet link: bad btmh info hash %q", hash)
+		}
+		if m.V2Hash != nil && string(m.V2Hash) != string(decoded[2:]) {
+			return fmt.Errorf("invalid magnet link: more than one btmh info hash")
+		}
 
+		m.V2Hash = decoded[2:]
 		return nil
-	} else {
-		return fmt.Errorf("invalid magnet link")
 	}
+
+	util.DebugLog("ignoring exact topic ", value)
+	return nil
+}
+
+// parseSelectOnly reads the so parameter, file indices and ranges like 0,2,4-6
+func parseSelectOnly(value string) ([]FileRange, error) {
+	var ranges []FileRange
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid magnet link: bad select only %q", value)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid magnet link: bad select only %q", value)
+			}
+		}
+		ranges = append(ranges, FileRange{First: start, Last: end})
+	}
+	return ranges, nil
+}
+
+// Selects reports whether the link asks for the file at index, every file is wanted if it doesn't say
+func (m *Magnet) Selects(index int) bool {
+	if m.Select == nil {
+		return true
+	}
+	for _, r := range m.Select {
+		if index >= r.First && index <= r.Last {
+			return true
+		}
+	}
+	return false
 }
 
+// GetPeers asks the trackers in the order of the link, until one of them answers with peers
 func (m *Magnet) GetPeers() ([]string, error) {
-	url := fmt.Sprintf("%s?info_hash=%s&peer_id=%s&port=%d&uploaded=0&downloaded=0&left=92063&compact=1",
-		m.URL, protocol.UrlEncodeWithConversion(m.InfoHash), "00112233445566778899", 6881)
+	if len(m.Trackers) == 0 {
+		return nil, fmt.Errorf("magnet link has no tracker")
+	}
+
+	var err error
+	for _, tracker := range m.Trackers {
+		var peers []string
+		peers, err = m.announce(tracker)
+		if err == nil && len(peers) > 0 {
+			return peers, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no peers from %s", tracker)
+		}
+		util.DebugLog("tracker failed: ", tracker, err)
+	}
+	return nil, err
+}
+
+// announceURL adds the announce parameters to the tracker URL, keeping any query it has already,
+// like the passkey of a private tracker
+func (m *Magnet) announceURL(tracker string) (string, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return "", fmt.Errorf("invalid tracker URL %q: %v", tracker, err)
+	}
+
+	left := m.Length
+	if left < 0 {
+		left = UNKNOWN_LEFT
+	}
+
+	query := u.Query()
+	query.Set("info_hash", string(m.InfoHashDecoded))
+	query.Set("peer_id", protocol.MY_PEER_ID)
+	query.Set("port", strconv.Itoa(protocol.LISTEN_PORT))
+	query.Set("uploaded", "0")
+	query.Set("downloaded", "0")
+	query.Set("left", strconv.FormatInt(left, 10))
+	query.Set("compact", "1")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// announce gets peers from a single tracker
+func (m *Magnet) announce(tracker string) ([]string, error) {
+	url, err := m.announceURL(tracker)
+	if err != nil {
+		return nil, err
+	}
 
 	response, err := http.Get(url)
 	if err != nil {
@@ -60,7 +280,7 @@ func (m *Magnet) GetPeers() ([]string, error) {
 	defer response.Body.Close()
 	body, err := io.ReadAll(response.Body)
 	if err != nil {
-		fmt.Println("Error reading response body:", err)
+		util.Logger.Println("Error reading response body:", err)
 	}
 
 	util.DebugLog("Response body: ", body)
@@ -0,0 +1,177 @@
+package extension
+
+import (
+	"encoding/hex"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testHash   = "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"
+	testBase32 = "22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7"
+	testV2Hash = "1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+)
+
+func TestMagnetParse(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want Magnet
+	}{
+		{
+			name: "hex btih",
+			link: "magnet:?xt=urn:btih:" + testHash + "&dn=sample.txt&tr=http%3A%2F%2Ftracker.example%2Fannounce",
+			want: Magnet{
+				URL: "http://tracker.example/announce", Trackers: []string{"http://tracker.example/announce"},
+				InfoHash: testHash, Name: "sample.txt", Length: -1,
+			},
+		},
+		{
+			name: "base32 btih",
+			link: "magnet:?xt=urn:btih:" + strings.ToLower(testBase32),
+			want: Magnet{InfoHash: testHash, Length: -1},
+		},
+		{
+			name: "hybrid with btmh",
+			link: "magnet:?xt=urn:btih:" + testHash + "&xt=urn:btmh:" + testV2Hash + "&xl=92063",
+			want: Magnet{InfoHash: testHash, V2Hash: mustHex(testV2Hash)[2:], Length: 92063},
+		},
+		{
+			name: "the same btih twice",
+			link: "magnet:?xt.1=urn:btih:" + testHash + "&xt.2=urn:btih:" + testBase32,
+			want: Magnet{InfoHash: testHash, Length: -1},
+		},
+		{
+			name: "no tracker",
+			link: "magnet:?xt=urn:btih:" + testHash + "&x.pe=10.0.0.1:6881&ws=http%3A%2F%2Fseed.example%2F",
+			want: Magnet{InfoHash: testHash, Length: -1, Peers: []string{"10.0.0.1:6881"}, WebSeeds: []string{"http://seed.example/"}},
+		},
+		{
+			name: "trackers in order",
+			link: "magnet:?tr.2=http%3A%2F%2Fb.example&xt=urn:btih:" + testHash + "&tr.1=http%3A%2F%2Fa.example",
+			want: Magnet{
+				URL: "http://b.example", Trackers: []string{"http://b.example", "http://a.example"},
+				InfoHash: testHash, Length: -1,
+			},
+		},
+		{
+			name: "select only",
+			link: "magnet:?xt=urn:btih:" + testHash + "&so=0,2,4-6",
+			want: Magnet{InfoHash: testHash, Length: -1, Select: []FileRange{{0, 0}, {2, 2}, {4, 6}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMagnet(tt.link)
+			if err := m.Parse(); err != nil {
+				t.Fatal(err)
+			}
+			tt.want.link = tt.link
+			tt.want.InfoHashDecoded = mustHex(tt.want.InfoHash)
+			if !reflect.DeepEqual(*m, tt.want) {
+				t.Fatalf("parsed %+v, want %+v", *m, tt.want)
+			}
+		})
+	}
+}
+
+func TestMagnetParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+	}{
+		{"not a magnet link", "http://example.com/?xt=urn:btih:" + testHash},
+		{"no xt", "magnet:?dn=sample.txt&tr=http%3A%2F%2Ftracker.example%2Fannounce"},
+		{"xt not a btih", "magnet:?xt=urn:sha1:" + testHash},
+		{"two different btih", "magnet:?xt=urn:btih:" + testHash + "&xt=urn:btih:" + strings.Repeat("0", 40)},
+		{"short btih", "magnet:?xt=urn:btih:" + testHash[:38]},
+		{"btih not hex", "magnet:?xt=urn:btih:" + strings.Repeat("z", 40)},
+		{"btih not base32", "magnet:?xt=urn:btih:" + strings.Repeat("1", 32)},
+		{"v2 only", "magnet:?xt=urn:btmh:" + testV2Hash},
+		{"btmh not sha2-256", "magnet:?xt=urn:btih:" + testHash + "&xt=urn:btmh:1120" + testV2Hash[4:]},
+		{"bad xl", "magnet:?xt=urn:btih:" + testHash + "&xl=-1"},
+		{"peer without a port", "magnet:?xt=urn:btih:" + testHash + "&x.pe=10.0.0.1"},
+		{"peer port out of range", "magnet:?xt=urn:btih:" + testHash + "&x.pe=10.0.0.1:70000"},
+		{"so range backwards", "magnet:?xt=urn:btih:" + testHash + "&so=6-4"},
+		{"so negative", "magnet:?xt=urn:btih:" + testHash + "&so=-1"},
+		{"so empty entry", "magnet:?xt=urn:btih:" + testHash + "&so=0,,2"},
+		{"so open range", "magnet:?xt=urn:btih:" + testHash + "&so=4-"},
+		{"so not a number", "magnet:?xt=urn:btih:" + testHash + "&so=a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMagnet(tt.link)
+			if err := m.Parse(); err == nil {
+				t.Fatalf("parsed %+v", *m)
+			}
+		})
+	}
+}
+
+func TestMagnetNoTracker(t *testing.T) {
+	m := NewMagnet("magnet:?xt=urn:btih:" + testHash)
+	if err := m.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetPeers(); err == nil {
+		t.Fatal("got peers from no tracker")
+	}
+}
+
+func TestMagnetAnnounceURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    string
+		tracker string
+		left    string
+		// query parameters of the tracker URL that must survive
+		keep url.Values
+	}{
+		{"exact length", "&xl=92063", "http://tracker.example/announce", "92063", nil},
+		{"unknown length", "", "http://tracker.example/announce", "16384", nil},
+		{"existing query", "", "http://tracker.example/announce?passkey=abc%2F1", "16384", url.Values{"passkey": {"abc/1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMagnet("magnet:?xt=urn:btih:" + testHash + tt.link)
+			if err := m.Parse(); err != nil {
+				t.Fatal(err)
+			}
+			announce, err := m.announceURL(tt.tracker)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := url.Parse(announce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Host != "tracker.example" || u.Path != "/announce" {
+				t.Fatalf("announce URL %s", announce)
+			}
+			query := u.Query()
+			if query.Get("info_hash") != string(mustHex(testHash)) || query.Get("left") != tt.left || query.Get("compact") != "1" {
+				t.Fatalf("announce URL %s", announce)
+			}
+			for key := range tt.keep {
+				if query.Get(key) != tt.keep.Get(key) {
+					t.Fatalf("announce URL %s lost %s", announce, key)
+				}
+			}
+		})
+	}
+}
+
+// mustHex decodes a hex string the test knows is valid
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
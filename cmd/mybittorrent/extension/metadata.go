@@ -0,0 +1,369 @@
+package extension
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// UT_METADATA is the BEP 9 extension name, UT_METADATA_ID the id we want to receive it as
+const (
+	UT_METADATA    = "ut_metadata"
+	UT_METADATA_ID = 1
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+const (
+	// METADATA_PIECE_SIZE is the size of every metadata piece but the last
+	METADATA_PIECE_SIZE = 16384
+	// MAX_METADATA_SIZE guards against peers announcing absurd sizes
+	MAX_METADATA_SIZE = 16 << 20
+	// METADATA_TIMEOUT bounds fetching the whole info dictionary from one peer
+	METADATA_TIMEOUT = 30 * time.Second
+	// METADATA_PARALLEL is how many peers are asked for the metadata at once
+	METADATA_PARALLEL = 5
+)
+
+// Handshake sends our extended handshake and waits for the peer's,
+// skipping whatever else the peer sends first, like its bitfield
+func Handshake(conn net.Conn) (ExtendedHandshake, error) {
+	registry := NewRegistry()
+	registry.Register(Extension{Name: UT_METADATA})
+
+	session := registry.NewSession(conn, nil, writeMessage(conn))
+	if err := session.Start(); err != nil {
+		return ExtendedHandshake{}, err
+	}
+
+	for !session.Ready() {
+		if err := readExtended(conn, session); err != nil {
+			return ExtendedHandshake{}, err
+		}
+	}
+	return session.Remote(), nil
+}
+
+// writeMessage sends straight to a connection nobody else writes to
+func writeMessage(conn net.Conn) func(protocol.Message) error {
+	return func(msg protocol.Message) error {
+		_, err := conn.Write(msg.Encode())
+		return err
+	}
+}
+
+// readExtended reads the next message, handing it to the session if it is an extended one
+func readExtended(conn net.Conn, session *Session) error {
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	if msg.Id != protocol.MsgExtended {
+		util.DebugLog("skipping message while waiting for extended messages: ", msg.Id)
+		return nil
+	}
+	return session.Handle(msg.Payload)
+}
+
+func newMetadataPayload(msgType int, piece int) ([]byte, error) {
+	return bencode.Encode(map[string]interface{}{
+		"msg_type": msgType,
+		"piece":    piece,
+	})
+}
+
+// parseMetadataMessage splits a ut_metadata message into its dictionary and the piece data following it
+func parseMetadataMessage(payload []byte) (int, int, []byte, error) {
+	decoded, rest, err := bencode.DecodeBencode(payload)
+	if err != nil {
+		return -1, -1, nil, fmt.Errorf("invalid ut_metadata message: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return -1, -1, nil, fmt.Errorf("ut_metadata message is not a dictionary")
+	}
+	msgType, ok := dict["msg_type"].(int)
+	if !ok {
+		return -1, -1, nil, fmt.Errorf("ut_metadata message without msg_type")
+	}
+	piece, ok := dict["piece"].(int)
+	if !ok {
+		return -1, -1, nil, fmt.Errorf("ut_metadata message without piece")
+	}
+	return msgType, piece, rest, nil
+}
+
+// metadataFetch assembles the info dictionary from the pieces a peer sends
+type metadataFetch struct {
+	size      int
+	metadata  []byte
+	received  []bool
+	remaining int
+}
+
+// joined requests every piece as soon as the peer says it has ut_metadata
+func (f *metadataFetch) joined(s *Session) error {
+	size := s.Remote().MetadataSize
+	if size <= 0 || size > MAX_METADATA_SIZE {
+		return fmt.Errorf("peer announced metadata size %d", size)
+	}
+
+	numPieces := (size + METADATA_PIECE_SIZE - 1) / METADATA_PIECE_SIZE
+	f.size = size
+	f.metadata = make([]byte, size)
+	f.received = make([]bool, numPieces)
+	f.remaining = numPieces
+
+	for i := 0; i < numPieces; i++ {
+		payload, err := newMetadataPayload(metadataRequest, i)
+		if err != nil {
+			return err
+		}
+		if err := s.Send(UT_METADATA, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *metadataFetch) handle(s *Session, payload []byte) error {
+	msgType, piece, data, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case metadataReject:
+		return fmt.Errorf("peer rejected metadata piece %d", piece)
+	case metadataData:
+	default:
+		return nil
+	}
+	if f.metadata == nil {
+		return fmt.Errorf("metadata piece before the handshake")
+	}
+
+	begin := piece * METADATA_PIECE_SIZE
+	expected := METADATA_PIECE_SIZE
+	if begin+expected > f.size {
+		expected = f.size - begin
+	}
+	if piece < 0 || piece >= len(f.received) || len(data) != expected {
+		return fmt.Errorf("invalid metadata piece %d of %d bytes", piece, len(data))
+	}
+	if !f.received[piece] {
+		copy(f.metadata[begin:], data)
+		f.received[piece] = true
+		f.remaining--
+	}
+	return nil
+}
+
+// ServeMetadata is ut_metadata for peers that want the info dictionary from us,
+// the registry's MetadataSize has to be set to its length
+func ServeMetadata(metadata []byte) Extension {
+	numPieces := (len(metadata) + METADATA_PIECE_SIZE - 1) / METADATA_PIECE_SIZE
+	return Extension{
+		Name: UT_METADATA,
+		Handle: func(s *Session, payload []byte) error {
+			msgType, piece, _, err := parseMetadataMessage(payload)
+			if err != nil {
+				return err
+			}
+			if msgType != metadataRequest {
+				return nil
+			}
+
+			if piece < 0 || piece >= numPieces {
+				reject, err := newMetadataPayload(metadataReject, piece)
+				if err != nil {
+					return err
+				}
+				return s.Send(UT_METADATA, reject)
+			}
+
+			reply, err := bencode.Encode(map[string]interface{}{
+				"msg_type":   metadataData,
+				"piece":      piece,
+				"total_size": len(metadata),
+			})
+			if err != nil {
+				return err
+			}
+			begin := piece * METADATA_PIECE_SIZE
+			end := begin + METADATA_PIECE_SIZE
+			if end > len(metadata) {
+				end = len(metadata)
+			}
+			return s.Send(UT_METADATA, append(reply, metadata[begin:end]...))
+		},
+	}
+}
+
+// FetchMetadata downloads the info dictionary from a peer that completed the regular handshake
+// with the extension bit set, and checks it against the info hash
+func FetchMetadata(conn net.Conn, infoHash []byte) (torrent.InfoDict, error) {
+	conn.SetDeadline(time.Now().Add(METADATA_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	f := &metadataFetch{}
+	registry := NewRegistry()
+	registry.Register(Extension{Name: UT_METADATA, Joined: f.joined, Handle: f.handle})
+
+	session := registry.NewSession(conn, nil, writeMessage(conn))
+	if err := session.Start(); err != nil {
+		return torrent.InfoDict{}, err
+	}
+
+	for f.metadata == nil || f.remaining > 0 {
+		if err := readExtended(conn, session); err != nil {
+			return torrent.InfoDict{}, err
+		}
+		if session.Ready() && !session.Supports(UT_METADATA) {
+			return torrent.InfoDict{}, fmt.Errorf("peer doesn't support %s", UT_METADATA)
+		}
+	}
+
+	return ParseMetadata(f.metadata, infoHash)
+}
+
+// FetchMetadataFromPeers asks up to parallel peers at once for the info dictionary,
+// moving on to the next address whenever one fails. The first verified copy wins
+func FetchMetadataFromPeers(addrs []string, infoHash []byte, parallel int) (torrent.InfoDict, error) {
+	if len(addrs) == 0 {
+		return torrent.InfoDict{}, fmt.Errorf("no peers to fetch the metadata from")
+	}
+
+	type result struct {
+		info torrent.InfoDict
+		err  error
+	}
+
+	next := make(chan string, len(addrs))
+	for _, addr := range addrs {
+		next <- addr
+	}
+	close(next)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	results := make(chan result, len(addrs))
+	for i := 0; i < parallel && i < len(addrs); i++ {
+		go func() {
+			for addr := range next {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				info, err := fetchMetadataFrom(addr, infoHash)
+				if err != nil {
+					util.DebugLog("fetching metadata from ", addr, " failed: ", err)
+					err = fmt.Errorf("%s: %v", addr, err)
+				}
+				results <- result{info, err}
+			}
+		}()
+	}
+
+	var lastErr error
+	for range addrs {
+		r := <-results
+		if r.err == nil {
+			return r.info, nil
+		}
+		lastErr = r.err
+	}
+	return torrent.InfoDict{}, fmt.Errorf("no peer sent the metadata, last error: %v", lastErr)
+}
+
+func fetchMetadataFrom(addr string, infoHash []byte) (torrent.InfoDict, error) {
+	peer, err := protocol.ConnectPeer(addr, infoHash, true)
+	if err != nil {
+		return torrent.InfoDict{}, err
+	}
+	defer peer.Conn.Close()
+
+	if !peer.Extensions {
+		return torrent.InfoDict{}, fmt.Errorf("peer doesn't support extensions")
+	}
+	return FetchMetadata(peer.Conn, infoHash)
+}
+
+// ParseMetadata verifies a bencoded info dictionary against the info hash and decodes it
+func ParseMetadata(metadata []byte, infoHash []byte) (torrent.InfoDict, error) {
+	hash := sha1.Sum(metadata)
+	if !bytes.Equal(hash[:], infoHash) {
+		return torrent.InfoDict{}, fmt.Errorf("metadata doesn't match the info hash")
+	}
+
+	decoded, rest, err := bencode.DecodeBencode(metadata)
+	if err != nil || len(rest) != 0 {
+		return torrent.InfoDict{}, fmt.Errorf("invalid metadata: %v", err)
+	}
+	infoMap, ok := decoded.(map[string]interface{})
+	if !ok {
+		return torrent.InfoDict{}, fmt.Errorf("metadata is not a dictionary")
+	}
+
+	info, err := torrent.InfoFromMap(infoMap)
+	if err != nil {
+		return torrent.InfoDict{}, err
+	}
+	info.Raw = metadata
+	return info, nil
+}
+
+// TorrentMetadata turns the magnet link and the fetched info dictionary into what a .torrent file would hold
+func (m *Magnet) TorrentMetadata(info torrent.InfoDict) torrent.TorrentMetadata {
+	return torrent.TorrentMetadata{Announce: m.URL, Info: info}
+}
+
+// TorrentFile builds a .torrent file from the magnet link and the fetched info dictionary.
+// The info dictionary is copied verbatim, so the file has the same info hash as the link
+func (m *Magnet) TorrentFile(info torrent.InfoDict) ([]byte, error) {
+	if info.Raw == nil {
+		return nil, fmt.Errorf("info dictionary wasn't fetched from a peer")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("d")
+	if m.URL != "" {
+		announce, err := bencode.Encode(m.URL)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("8:announce")
+		buf.Write(announce)
+	}
+	if len(m.Trackers) > 1 {
+		// one tier per tracker, tried in the order of the link
+		tiers := make([]interface{}, len(m.Trackers))
+		for i, tracker := range m.Trackers {
+			tiers[i] = []string{tracker}
+		}
+		announceList, err := bencode.Encode(tiers)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("13:announce-list")
+		buf.Write(announceList)
+	}
+	buf.WriteString("4:info")
+	buf.Write(info.Raw)
+	buf.WriteString("e")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,230 @@
+package extension
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+const (
+	// PEX_INTERVAL is the least time between two ut_pex messages to the same peer
+	PEX_INTERVAL = time.Minute
+	// PEX_MIN_INTERVAL is how often we accept ut_pex messages from a peer, a bit of leeway for timer jitter
+	PEX_MIN_INTERVAL = 45 * time.Second
+	// PEX_MAX_PEERS caps both the added and the dropped peers of one message
+	PEX_MAX_PEERS = 50
+)
+
+// peer flags of added.f and added6.f
+const (
+	PEX_ENCRYPTION = 0x01
+	// PEX_SEED marks seeds and peers that are upload only
+	PEX_SEED      = 0x02
+	PEX_UTP       = 0x04
+	PEX_HOLEPUNCH = 0x08
+	// PEX_OUTGOING marks peers the sender connected to, so their address is known to accept connections
+	PEX_OUTGOING = 0x10
+)
+
+// PexPeer is a peer address with its ut_pex flags
+type PexPeer struct {
+	Addr  string
+	Flags byte
+}
+
+// PexMessage is one ut_pex message, addresses are ip:port, IPv4 and IPv6 alike
+type PexMessage struct {
+	Added   []PexPeer
+	Dropped []string
+}
+
+// compactAddr packs an address as 4 or 16 bytes of IP followed by the port, the second result tells if it's IPv6
+func compactAddr(addr string) ([]byte, bool, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return nil, false, fmt.Errorf("invalid address %q", addr)
+	}
+
+	ipv6 := ip.To4() == nil
+	if !ipv6 {
+		ip = ip.To4()
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), uint16(port)), ipv6, nil
+}
+
+// parseCompact unpacks a list of compact addresses of ipLen byte IPs each
+func parseCompact(data []byte, ipLen int) ([]string, error) {
+	size := ipLen + 2
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("compact peers of %d bytes", len(data))
+	}
+
+	addrs := make([]string, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		ip := net.IP(data[i : i+ipLen])
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+size])
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return addrs, nil
+}
+
+// Encode turns the message into the bencoded payload, addresses that don't parse are left out
+func (m PexMessage) Encode() ([]byte, error) {
+	var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+	for _, p := range m.Added {
+		compact, ipv6, err := compactAddr(p.Addr)
+		if err != nil {
+			continue
+		}
+		if ipv6 {
+			added6 = append(added6, compact...)
+			added6Flags = append(added6Flags, p.Flags)
+		} else {
+			added = append(added, compact...)
+			addedFlags = append(addedFlags, p.Flags)
+		}
+	}
+	for _, addr := range m.Dropped {
+		compact, ipv6, err := compactAddr(addr)
+		if err != nil {
+			continue
+		}
+		if ipv6 {
+			dropped6 = append(dropped6, compact...)
+		} else {
+			dropped = append(dropped, compact...)
+		}
+	}
+
+	dict := map[string]interface{}{
+		"added":   added,
+		"added.f": addedFlags,
+		"dropped": dropped,
+	}
+	// the IPv6 keys are only sent when there is something in them
+	if len(added6) > 0 {
+		dict["added6"] = added6
+		dict["added6.f"] = added6Flags
+	}
+	if len(dropped6) > 0 {
+		dict["dropped6"] = dropped6
+	}
+	return bencode.Encode(dict)
+}
+
+// ParsePex reads a ut_pex payload. Flags are optional, peers without one get 0.
+// Like we do, peers must send no more than PEX_MAX_PEERS added and dropped peers, anything beyond is ignored
+func ParsePex(payload []byte) (PexMessage, error) {
+	decoded, _, err := bencode.DecodeBencode(payload)
+	if err != nil {
+		return PexMessage{}, fmt.Errorf("invalid ut_pex message: %v", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return PexMessage{}, fmt.Errorf("ut_pex message is not a dictionary")
+	}
+
+	var m PexMessage
+	for _, family := range []struct {
+		suffix string
+		ipLen  int
+	}{{"", net.IPv4len}, {"6", net.IPv6len}} {
+		added, err := parseCompact(bencode.Bytes(dict["added"+family.suffix]), family.ipLen)
+		if err != nil {
+			return PexMessage{}, err
+		}
+		flags := bencode.Bytes(dict["added"+family.suffix+".f"])
+		for i, addr := range added {
+			if len(m.Added) == PEX_MAX_PEERS {
+				break
+			}
+			p := PexPeer{Addr: addr}
+			if i < len(flags) {
+				p.Flags = flags[i]
+			}
+			m.Added = append(m.Added, p)
+		}
+
+		dropped, err := parseCompact(bencode.Bytes(dict["dropped"+family.suffix]), family.ipLen)
+		if err != nil {
+			return PexMessage{}, err
+		}
+		m.Dropped = append(m.Dropped, dropped...)
+	}
+	if len(m.Dropped) > PEX_MAX_PEERS {
+		m.Dropped = m.Dropped[:PEX_MAX_PEERS]
+	}
+	return m, nil
+}
+
+// PexState is what one peer was told and sent through ut_pex. Not safe for concurrent use
+type PexState struct {
+	// addresses the peer knows about from us, with the flags we sent
+	sent     map[string]byte
+	lastSent time.Time
+	lastRecv time.Time
+}
+
+func NewPexState() *PexState {
+	return &PexState{sent: make(map[string]byte)}
+}
+
+// Update compares the peers we're connected to now with what the peer was told before and
+// returns the message telling it the difference. Nothing is returned within PEX_INTERVAL
+// of the last message, or when nothing changed. Peers beyond PEX_MAX_PEERS wait for the next round
+func (s *PexState) Update(connected []PexPeer, now time.Time) (PexMessage, bool) {
+	if !s.lastSent.IsZero() && now.Sub(s.lastSent) < PEX_INTERVAL {
+		return PexMessage{}, false
+	}
+
+	current := make(map[string]byte, len(connected))
+	for _, p := range connected {
+		current[p.Addr] = p.Flags
+	}
+
+	var m PexMessage
+	for _, p := range connected {
+		if flags, ok := s.sent[p.Addr]; (!ok || flags != p.Flags) && len(m.Added) < PEX_MAX_PEERS {
+			m.Added = append(m.Added, p)
+		}
+	}
+	for addr := range s.sent {
+		if _, ok := current[addr]; !ok && len(m.Dropped) < PEX_MAX_PEERS {
+			m.Dropped = append(m.Dropped, addr)
+		}
+	}
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return PexMessage{}, false
+	}
+	// deterministic output, map order isn't
+	sort.Strings(m.Dropped)
+
+	for _, p := range m.Added {
+		s.sent[p.Addr] = p.Flags
+	}
+	for _, addr := range m.Dropped {
+		delete(s.sent, addr)
+	}
+	s.lastSent = now
+	return m, true
+}
+
+// Received reports whether a message from the peer arriving now respects the interval,
+// those that come too quickly should be ignored
+func (s *PexState) Received(now time.Time) bool {
+	if !s.lastRecv.IsZero() && now.Sub(s.lastRecv) < PEX_MIN_INTERVAL {
+		return false
+	}
+	s.lastRecv = now
+	return true
+}
@@ -0,0 +1,240 @@
+package extension
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// CLIENT_VERSION is what we call ourselves in the extended handshake
+const CLIENT_VERSION = "mybittorrent 0.1"
+
+// names of the extensions we know of
+const (
+	UT_PEX       = "ut_pex"
+	LT_DONTHAVE  = "lt_donthave"
+	UPLOAD_ONLY  = "upload_only"
+	UT_HOLEPUNCH = "ut_holepunch"
+)
+
+// Extension is one protocol extension on top of BEP 10
+type Extension struct {
+	// Name is the key in the handshake's m dictionary, like ut_metadata
+	Name string
+	// Joined is called once the peer's extended handshake says it supports the extension, may be nil
+	Joined func(s *Session) error
+	// Handle gets the payload of every message the peer sends for the extension, without the id
+	Handle func(s *Session, payload []byte) error
+}
+
+// Registry holds the extensions we support. Their message ids, the ones peers use to send to us,
+// follow the order of registration. A registry is shared by all sessions and must not change once they start
+type Registry struct {
+	// V is our client name and version
+	V string
+	// Reqq is how many outstanding requests we accept, 0 leaves it out
+	Reqq int
+	// MetadataSize is the size of the info dictionary we can hand out, 0 if we can't
+	MetadataSize int
+	// Port is where we accept incoming connections, 0 if we don't
+	Port int
+
+	extensions []Extension
+}
+
+func NewRegistry() *Registry {
+	return &Registry{V: CLIENT_VERSION}
+}
+
+// Register adds an extension. Extensions are fixed at compile time, so registering one without a name,
+// the same name twice or more than 255 of them is a bug and panics
+func (r *Registry) Register(e Extension) {
+	if e.Name == "" {
+		panic("extension without a name")
+	}
+	if r.id(e.Name) != 0 {
+		panic(fmt.Sprintf("extension %s registered twice", e.Name))
+	}
+	// 0 is the handshake
+	if len(r.extensions) == 255 {
+		panic("too many extensions")
+	}
+	r.extensions = append(r.extensions, e)
+}
+
+// id is the message id we receive an extension as, 0 if it isn't registered
+func (r *Registry) id(name string) int {
+	for i, e := range r.extensions {
+		if e.Name == name {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Handshake is our extended handshake, remote is the peer's address, echoed back as yourip
+func (r *Registry) Handshake(remote net.Addr) ExtendedHandshake {
+	h := ExtendedHandshake{
+		M:            make(map[string]int, len(r.extensions)),
+		V:            r.V,
+		Reqq:         r.Reqq,
+		MetadataSize: r.MetadataSize,
+		Port:         r.Port,
+	}
+	for i, e := range r.extensions {
+		h.M[e.Name] = i + 1
+	}
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		h.YourIP = addr.IP
+	}
+	return h
+}
+
+// NewSession sets up the extension protocol with one peer, send queues a message to it.
+// peer may be nil where there is only a bare connection, like when fetching metadata
+func (r *Registry) NewSession(conn net.Conn, peer *protocol.Peer, send func(protocol.Message) error) *Session {
+	return &Session{
+		Conn:     conn,
+		Peer:     peer,
+		registry: r,
+		send:     send,
+		joined:   make(map[string]bool),
+	}
+}
+
+// Session is the extension protocol state with one peer
+type Session struct {
+	Conn net.Conn
+	Peer *protocol.Peer
+
+	registry *Registry
+	send     func(protocol.Message) error
+
+	mu sync.Mutex
+	// remote is the latest handshake from the peer
+	remote ExtendedHandshake
+	ready  bool
+	// extensions whose Joined was called already
+	joined map[string]bool
+}
+
+// Start sends our extended handshake
+func (s *Session) Start() error {
+	msg, err := NewExtendedHandshakeMessage(s.registry.Handshake(s.Conn.RemoteAddr()))
+	if err != nil {
+		return err
+	}
+	return s.send(msg)
+}
+
+// Ready reports whether the peer's extended handshake came in
+func (s *Session) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// Remote is the peer's extended handshake, with client name, reqq, yourip and so on.
+// Zero until Ready
+func (s *Session) Remote() ExtendedHandshake {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+// Supports reports whether the peer can receive the extension
+func (s *Session) Supports(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.remote.M[name]
+	return ok
+}
+
+// Send sends an extension message with the id the peer assigned to it
+func (s *Session) Send(name string, payload []byte) error {
+	s.mu.Lock()
+	id, ok := s.remote.M[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer doesn't support %s", name)
+	}
+	return s.send(NewExtendedMessage(id, payload))
+}
+
+// Handle dispatches the payload of a message with id 20 to the extension it belongs to
+func (s *Session) Handle(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("empty extended message")
+	}
+
+	id := int(payload[0])
+	if id == EXTENDED_HANDSHAKE_ID {
+		return s.handshake(payload[1:])
+	}
+
+	if id > len(s.registry.extensions) {
+		// not something we offered, may be left over from before a handshake update
+		util.DebugLog("ignoring extended message with unknown id ", id)
+		return nil
+	}
+	e := s.registry.extensions[id-1]
+	if e.Handle == nil {
+		return nil
+	}
+	if err := e.Handle(s, payload[1:]); err != nil {
+		return fmt.Errorf("%s: %v", e.Name, err)
+	}
+	return nil
+}
+
+// handshake takes in the peer's handshake. Later ones only update what they mention,
+// so an extension can be switched off with an id of 0 but the rest stays
+func (s *Session) handshake(payload []byte) error {
+	h, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.ready {
+		// a fresh map, Remote hands out the old one
+		m := make(map[string]int, len(s.remote.M))
+		for name, id := range s.remote.M {
+			m[name] = id
+		}
+		if disabled, ok := h.Dict["m"].(map[string]interface{}); ok {
+			for name := range disabled {
+				delete(m, name)
+			}
+		}
+		for name, id := range h.M {
+			m[name] = id
+		}
+		h.M = m
+	}
+	s.remote = h
+	s.ready = true
+
+	var joined []Extension
+	for _, e := range s.registry.extensions {
+		if _, ok := h.M[e.Name]; ok && !s.joined[e.Name] {
+			s.joined[e.Name] = true
+			joined = append(joined, e)
+		}
+	}
+	s.mu.Unlock()
+
+	util.DebugLog("extended handshake from ", s.Conn.RemoteAddr(), ": ", h.V, h.M)
+	for _, e := range joined {
+		if e.Joined == nil {
+			continue
+		}
+		if err := e.Joined(s); err != nil {
+			return fmt.Errorf("%s: %v", e.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+const (
+	// LSD_GROUP is the IPv4 multicast group and port of BEP 14, LSD_GROUP6 the IPv6 one
+	LSD_GROUP  = "239.192.152.143:6771"
+	LSD_GROUP6 = "[ff15::efc0:988f]:6771"
+	// ANNOUNCE_INTERVAL is how often every torrent is announced
+	ANNOUNCE_INTERVAL = 5 * time.Minute
+	// MIN_INTERVAL is the least time between two announces of the same torrent
+	MIN_INTERVAL = time.Minute
+	// MAX_PACKET is the largest announce we read
+	MAX_PACKET = 1400
+	// LOOKUP_WAIT is how long Lookup listens for answers to its announce
+	LOOKUP_WAIT = 5 * time.Second
+)
+
+// torrentState is a torrent we announce and look for peers of
+type torrentState struct {
+	infoHash     string // upper case hex, as announced
+	lastAnnounce time.Time
+	found        func(addr string)
+}
+
+// Service announces torrents to the local network and listens for others doing the same (BEP 14).
+// Peers found are handed to the callback of the torrent, our own announces are recognised by a cookie
+type Service struct {
+	// Port is the TCP port we accept peer connections on
+	Port int
+
+	// conn is bound to the group and only receives, announces go out through send
+	conn   *net.UDPConn
+	send   *net.UDPConn
+	group  *net.UDPAddr
+	cookie string
+
+	mu       sync.Mutex
+	torrents map[string]*torrentState
+}
+
+// New joins the multicast group, e.g. LSD_GROUP, and starts listening
+func New(group string, port int) (*Service, error) {
+	network := "udp4"
+	if strings.HasPrefix(group, "[") {
+		network = "udp6"
+	}
+	groupAddr, err := net.ResolveUDPAddr(network, group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP(network, nil, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	s := &Service{
+		Port:     port,
+		conn:     conn,
+		send:     send,
+		group:    groupAddr,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[string]*torrentState),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// Add starts announcing a torrent, found is called with the ip:port of every peer announcing it.
+// found runs on the listener goroutine and must not block
+func (s *Service) Add(infoHash []byte, found func(addr string)) {
+	key := strings.ToUpper(hex.EncodeToString(infoHash))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[key] = &torrentState{infoHash: key, found: found}
+}
+
+// Remove stops announcing a torrent
+func (s *Service) Remove(infoHash []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, strings.ToUpper(hex.EncodeToString(infoHash)))
+}
+
+// Run announces every torrent right away and then every ANNOUNCE_INTERVAL, until ctx is done
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(ANNOUNCE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := s.announce(nil, time.Now()); err != nil {
+			util.DebugLog("LSD announce failed: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// announce sends one message for the given torrents, all of them if nil,
+// leaving out those announced within MIN_INTERVAL
+func (s *Service) announce(only map[string]bool, now time.Time) error {
+	s.mu.Lock()
+	var infoHashes []string
+	for key, t := range s.torrents {
+		if only != nil && !only[key] {
+			continue
+		}
+		if !t.lastAnnounce.IsZero() && now.Sub(t.lastAnnounce) < MIN_INTERVAL {
+			continue
+		}
+		t.lastAnnounce = now
+		infoHashes = append(infoHashes, key)
+	}
+	s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		return nil
+	}
+	_, err := s.send.WriteToUDP(s.message(infoHashes), s.group)
+	return err
+}
+
+// message is a BT-SEARCH announce, an HTTP request sent over UDP
+func (s *Service) message(infoHashes []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", s.group)
+	fmt.Fprintf(&buf, "Port: %d\r\n", s.Port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&buf, "Infohash: %s\r\n", infoHash)
+	}
+	fmt.Fprintf(&buf, "cookie: %s\r\n", s.cookie)
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// parseMessage reads a BT-SEARCH announce, returning the port and the upper case info hashes
+func parseMessage(data []byte) (int, []string, string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if req.Method != "BT-SEARCH" {
+		return 0, nil, "", fmt.Errorf("unexpected method %q", req.Method)
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, "", fmt.Errorf("invalid port %q", req.Header.Get("Port"))
+	}
+
+	var infoHashes []string
+	for _, infoHash := range req.Header.Values("Infohash") {
+		if b, err := hex.DecodeString(infoHash); err == nil && len(b) == 20 {
+			infoHashes = append(infoHashes, strings.ToUpper(infoHash))
+		}
+	}
+	return port, infoHashes, req.Header.Get("Cookie"), nil
+}
+
+func (s *Service) readLoop() {
+	buf := make([]byte, MAX_PACKET)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			util.DebugLog("LSD listener stopped: ", err)
+			return
+		}
+
+		port, infoHashes, cookie, err := parseMessage(buf[:n])
+		if err != nil {
+			util.DebugLog("dropping LSD packet from ", from, err)
+			continue
+		}
+		if cookie == s.cookie {
+			continue
+		}
+		s.received(net.JoinHostPort(from.IP.String(), strconv.Itoa(port)), infoHashes)
+	}
+}
+
+// received hands a peer to the torrents it announced that we have too.
+// Those we haven't announced in a while are announced back right away,
+// so a client that just started finds us without waiting for our next round
+func (s *Service) received(addr string, infoHashes []string) {
+	s.mu.Lock()
+	var found []func(string)
+	ours := make(map[string]bool)
+	for _, infoHash := range infoHashes {
+		if t, ok := s.torrents[infoHash]; ok {
+			found = append(found, t.found)
+			ours[infoHash] = true
+		}
+	}
+	s.mu.Unlock()
+
+	for _, f := range found {
+		f(addr)
+	}
+	if len(ours) > 0 {
+		if err := s.announce(ours, time.Now()); err != nil {
+			util.DebugLog("LSD announce failed: ", err)
+		}
+	}
+}
+
+func (s *Service) Close() error {
+	s.send.Close()
+	return s.conn.Close()
+}
+
+// Lookup announces a torrent once and collects the peers announcing it within wait.
+// BEP 14 has no replies, only clients that announce back like Service does are sure to be found,
+// and not if they announced within the last MIN_INTERVAL. Others announce every ANNOUNCE_INTERVAL,
+// a wait that long finds them too
+func Lookup(group string, port int, infoHash []byte, wait time.Duration) ([]string, error) {
+	s, err := New(group, port)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var peers []string
+	s.Add(infoHash, func(addr string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !seen[addr] {
+			seen[addr] = true
+			peers = append(peers, addr)
+		}
+	})
+
+	if err := s.announce(nil, time.Now()); err != nil {
+		return nil, err
+	}
+	time.Sleep(wait)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return peers, nil
+}
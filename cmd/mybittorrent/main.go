@@ -7,14 +7,20 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/ztrue/tracerr"
 	// bencode "github.com/jackpal/bencode-go" // Available if you need it!
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/dht"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/extension"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/lsd"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/worker"
@@ -23,25 +29,25 @@ import (
 func decodeFile(fileName string) (torrent.TorrentMetadata, error) {
 	content, err := os.ReadFile(fileName)
 	if err != nil {
-		fmt.Println("Error reading file:", err)
+		util.Logger.Println("Error reading file:", err)
 		return torrent.TorrentMetadata{}, tracerr.Wrap(err)
 	}
 
 	metadataMap, rest, err := bencode.DecodeBencode(content)
 	if err != nil {
-		fmt.Println("bencode.DecodeBencode error:", err)
+		util.Logger.Println("bencode.DecodeBencode error:", err)
 		return torrent.TorrentMetadata{}, tracerr.Wrap(err)
 	}
 
 	if len(rest) != 0 {
-		fmt.Println("Rest is not empty. Invalid syntax")
+		util.Logger.Println("Rest is not empty. Invalid syntax")
 		return torrent.TorrentMetadata{}, tracerr.Wrap(err)
 	}
 
 	// Type assertion to convert interface{} to map[string]interface{}
 	decodedMap, ok := metadataMap.(map[string]interface{})
 	if !ok {
-		fmt.Println("Failed to type assert metadataMap to map[string]interface{}")
+		util.Logger.Println("Failed to type assert metadataMap to map[string]interface{}")
 		return torrent.TorrentMetadata{}, tracerr.Wrap(err)
 	}
 
@@ -52,18 +58,16 @@ func decodeFile(fileName string) (torrent.TorrentMetadata, error) {
 	}
 
 	if infoMap, ok := decodedMap["info"].(map[string]interface{}); ok {
-		var infoDict torrent.InfoDict
-		if length, ok := infoMap["length"].(int); ok {
-			infoDict.Length = length
-		}
-		if name, ok := infoMap["name"].(string); ok {
-			infoDict.Name = string(name)
-		}
-		if pieceLength, ok := infoMap["piece length"].(int); ok {
-			infoDict.PieceLength = pieceLength
+		infoDict, err := torrent.InfoFromMap(infoMap)
+		if err != nil {
+			util.Logger.Println("Invalid info dictionary:", err)
+			return torrent.TorrentMetadata{}, tracerr.Wrap(err)
 		}
-		if pieces, ok := infoMap["pieces"].([]byte); ok {
-			infoDict.Pieces = pieces // pieces are non-UTF-8 bytes
+		// hashed as found in the file, it may hold keys we don't model such as private or source
+		infoDict.Raw, err = bencode.RawValue(content, "info")
+		if err != nil {
+			util.Logger.Println("Invalid info dictionary:", err)
+			return torrent.TorrentMetadata{}, tracerr.Wrap(err)
 		}
 		torrentMetadata.Info = infoDict
 	}
@@ -71,6 +75,574 @@ func decodeFile(fileName string) (torrent.TorrentMetadata, error) {
 	return torrentMetadata, nil
 }
 
+// downloadOptions are the flags following download_x's positional arguments
+type downloadOptions struct {
+	sequential bool
+	// file rules in command line order, only given for multi file torrents
+	rules []worker.FileRule
+	// with --only every file not matched is skipped
+	only bool
+	// files a magnet link asks for (BEP 53), the others are skipped unless rules say otherwise.
+	// Nil means every file
+	selected func(index int) bool
+	// HTTP sources of the payload from a magnet link (BEP 19)
+	webSeeds   []string
+	allocation storage.Allocation
+	// memory cap of the piece cache in bytes
+	cacheSize int
+	// peers unchoked for their rates, besides the optimistic unchoke
+	uploadSlots int
+}
+
+func parseDownloadOptions(args []string) (downloadOptions, error) {
+	opts := downloadOptions{allocation: storage.AllocGrow, cacheSize: storage.CACHE_SIZE, uploadSlots: worker.UPLOAD_SLOTS}
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if flag == "--sequential" {
+			opts.sequential = true
+			continue
+		}
+
+		if flag != "--only" && flag != "--skip" && flag != "--priority" && flag != "--alloc" && flag != "--cache" && flag != "--upload-slots" {
+			return opts, fmt.Errorf("unknown option %s", flag)
+		}
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("%s needs a value", flag)
+		}
+		i++
+		value := args[i]
+
+		switch flag {
+		case "--only":
+			opts.only = true
+			opts.rules = append(opts.rules, worker.FileRule{Pattern: value, Priority: worker.PriorityNormal})
+		case "--skip":
+			opts.rules = append(opts.rules, worker.FileRule{Pattern: value, Priority: worker.PrioritySkip})
+		case "--priority":
+			// <glob>=<skip|low|normal|high>
+			sep := strings.LastIndex(value, "=")
+			if sep == -1 {
+				return opts, fmt.Errorf("--priority expects <glob>=<priority>, got %s", value)
+			}
+			priority, err := worker.ParsePriority(value[sep+1:])
+			if err != nil {
+				return opts, err
+			}
+			opts.rules = append(opts.rules, worker.FileRule{Pattern: value[:sep], Priority: priority})
+		case "--alloc":
+			allocation, err := storage.ParseAllocation(value)
+			if err != nil {
+				return opts, err
+			}
+			opts.allocation = allocation
+		case "--cache":
+			// in MiB
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return opts, fmt.Errorf("invalid cache size %s", value)
+			}
+			opts.cacheSize = size << 20
+		case "--upload-slots":
+			slots, err := parseUploadSlots(value)
+			if err != nil {
+				return opts, err
+			}
+			opts.uploadSlots = slots
+		}
+	}
+	return opts, nil
+}
+
+// picksFiles reports whether files were picked with --only or skipped on the command line,
+// which takes over from the selection of a magnet link
+func (opts downloadOptions) picksFiles() bool {
+	if opts.only {
+		return true
+	}
+	for _, r := range opts.rules {
+		if r.Priority == worker.PrioritySkip {
+			return true
+		}
+	}
+	return false
+}
+
+func parseUploadSlots(value string) (int, error) {
+	slots, err := strconv.Atoi(value)
+	if err != nil || slots < 0 {
+		return 0, fmt.Errorf("invalid number of upload slots %s", value)
+	}
+	return slots, nil
+}
+
+// streamDownload writes the torrent's payload to stdout in order, e.g. to pipe it into tar.
+// Only a few pieces past the next one to write are downloaded at any time, so memory stays bounded
+func streamDownload(fileName string) error {
+	// stdout carries the payload, everything else goes to stderr
+	util.Logger.SetOutput(os.Stderr)
+
+	torrent, err := decodeFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	peersList, err := protocol.GetPeers(torrent)
+	if err != nil {
+		return err
+	}
+
+	util.Logger.Println("Streaming", fileName, "from", peersList)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	numPieces := len(torrent.Info.Pieces) / 20
+	picker := worker.NewStreamingPicker(numPieces, storage.STREAM_WINDOW)
+	// pieces go out as soon as they are verified. The cache has room for the whole window,
+	// so it never has to spill incomplete pieces to the stream, which only takes whole ones
+	store := storage.NewPieceCache(storage.NewStreamStorage(os.Stdout, torrent.Info), torrent.Info, (storage.STREAM_WINDOW+1)*torrent.Info.PieceLength)
+	store.WriteThrough = true
+
+	dl := worker.NewDownloader(nil, &torrent, picker, store)
+	swarm := worker.NewSwarm(torrent.Info.Hash(), worker.TARGET_PEERS, dl.Bans)
+	swarm.AddCandidates(peersList, worker.SourceTracker)
+	swarm.Refresh = func() ([]string, error) {
+		return protocol.GetPeers(torrent)
+	}
+	dl.Swarm = swarm
+	// no LSD: nothing listens on the port it would announce, the stream can't serve pieces anyway
+	go swarm.Run(ctx)
+
+	err = dl.Run(ctx)
+	if err != nil {
+		return err
+	}
+	return store.Complete()
+}
+
+// downloadTorrent runs the concurrent download of a torrent to filePath, returning the exit code.
+// extraPeers are tried besides the ones from the tracker, e.g. peers from a magnet link
+func downloadTorrent(torrent torrent.TorrentMetadata, fileName string, filePath string, opts downloadOptions, extraPeers []string) int {
+	var err error
+
+	// which files to fetch, only multi file torrents can be picked apart
+	var filePriorities []worker.Priority
+	var skip []bool
+	if len(opts.rules) > 0 || opts.selected != nil {
+		if len(torrent.Info.Files) == 0 {
+			fmt.Println("--only, --skip and --priority need a multi file torrent")
+			return 1
+		}
+
+		def := worker.PriorityNormal
+		if opts.only {
+			def = worker.PrioritySkip
+		}
+		filePriorities = make([]worker.Priority, len(torrent.Info.Files))
+		for i := range filePriorities {
+			filePriorities[i] = def
+			if opts.selected != nil && !opts.selected(i) {
+				filePriorities[i] = worker.PrioritySkip
+			}
+		}
+		err = worker.ApplyFileRules(torrent.Info, filePriorities, opts.rules)
+		if err != nil {
+			fmt.Println("Error selecting files:", err)
+			return 1
+		}
+
+		skip = make([]bool, len(filePriorities))
+		for i, f := range torrent.Info.Files {
+			skip[i] = filePriorities[i] == worker.PrioritySkip
+			fmt.Printf("%-6s %s (%d bytes)\n", filePriorities[i], f.DisplayPath(), f.Length)
+		}
+	}
+
+	// better to refuse now than to run out of space halfway through
+	storeOpts := storage.Options{Skip: skip, Allocation: opts.allocation}
+	err = storage.CheckSpace(filePath, torrent.Info, storeOpts)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+
+	peersList, err := protocol.GetPeers(torrent)
+	if err != nil && len(extraPeers) == 0 && len(opts.webSeeds) == 0 {
+		tracerr.PrintSourceColor(err)
+		return 1
+	}
+	if err != nil {
+		fmt.Println("Error getting peers from tracker:", err)
+	}
+	peersList = append(peersList, extraPeers...)
+
+	fmt.Printf("Downloading %s from %v\n", fileName, peersList)
+	if len(opts.webSeeds) > 0 {
+		fmt.Printf("and the web seeds %v\n", opts.webSeeds)
+	}
+
+	// initiatilizing ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+	go func() {
+		// wait until receiving the signal
+		select {
+		case <-sigCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// split the file into pieces
+	piecesHash := bencode.SplitPiecesIntoHashes(torrent.Info.Pieces)
+
+	// rarest first by default, with the first few pieces picked at random
+	var picker worker.PiecePicker
+	if opts.sequential {
+		picker = worker.NewSequentialPicker(len(piecesHash))
+	} else {
+		picker = worker.NewRarestFirstPicker(len(piecesHash), 4, nil)
+	}
+	if filePriorities != nil {
+		for i, priority := range worker.PiecePriorities(torrent.Info, filePriorities) {
+			picker.SetPriority(i, priority)
+		}
+	}
+
+	// looked at before the storage creates the files
+	existing := storage.HasData(filePath, torrent.Info)
+
+	// read before opening the storage, which may touch the files and invalidate it
+	resume := storage.NewResume(filePath, torrent.Info, storeOpts)
+	saved, resumeErr := resume.Load()
+
+	// multi file torrents go into a directory below filePath
+	store, err := storage.Open(filePath, torrent.Info, storeOpts)
+	if err != nil {
+		fmt.Println("Error creating file:", err)
+		return 1
+	}
+	// blocks are assembled and verified in memory and written back in batches
+	store = storage.NewPieceCache(store, torrent.Info, opts.cacheSize)
+	defer store.Close()
+
+	// peers are connected in the background and replaced as they drop
+	dl := worker.NewDownloader(nil, &torrent, picker, store)
+	dl.Resume = resume
+	dl.Choker.Slots = opts.uploadSlots
+	dl.WebSeeds = opts.webSeeds
+
+	// carry on from a previous run, the resume file is only trusted while the data is unchanged
+	if existing {
+		verified := saved.Verified
+		if resumeErr != nil {
+			fmt.Println("No usable resume file:", resumeErr)
+			fmt.Println("Checking existing data in", filePath)
+			verified = storage.Recheck(store, torrent.Info)
+		} else {
+			dl.Downloaded = saved.Downloaded
+			dl.Uploaded = saved.Uploaded
+		}
+		for i := range piecesHash {
+			if verified.Has(i) {
+				picker.Done(i)
+			}
+		}
+		dl.Verified = verified
+		fmt.Printf("Resuming with %d of %d pieces\n", verified.Count(), len(piecesHash))
+	}
+	swarm := worker.NewSwarm(torrent.Info.Hash(), worker.TARGET_PEERS, dl.Bans)
+	swarm.AddCandidates(peersList, worker.SourceTracker)
+	if existing && resumeErr == nil {
+		swarm.AddCandidates(saved.Peers, worker.SourceResume)
+	}
+	swarm.Refresh = func() ([]string, error) {
+		return protocol.GetPeers(torrent)
+	}
+	dl.Swarm = swarm
+	go swarm.Run(ctx)
+
+	// downloading works without, but peers that can't reach us won't share as much.
+	// LSD announces the port, so only once it's ours
+	err = startListener(ctx, dl)
+	if err != nil {
+		util.DebugLog("not accepting incoming connections: ", err)
+	} else {
+		startLSD(ctx, torrent.Info.Hash(), swarm)
+	}
+
+	go func() {
+		select {
+		case <-dl.EndgameStarted():
+			fmt.Println("Entering endgame mode")
+		case <-ctx.Done():
+		}
+	}()
+
+	// one goroutine per peer, returns once every piece is verified or nobody can help any more
+	// connections are closed by the time it returns
+	err = dl.Run(ctx)
+	if err != nil {
+		fmt.Println("Error downloading:", err)
+	}
+
+	if remaining := dl.Picker.Remaining(); remaining > 0 {
+		fmt.Printf("Download incomplete: %d pieces could not be verified %v\n", remaining, dl.Unverified())
+		fmt.Printf("Progress saved to %s, run the same command again to resume\n", storage.ResumePath(filePath))
+		return 1
+	}
+
+	// moves temp files into place, the resume file stays until that worked
+	err = store.Complete()
+	if err != nil {
+		fmt.Println("Error completing download:", err)
+		return 1
+	}
+
+	err = resume.Remove()
+	if err != nil {
+		fmt.Println("Error removing resume file:", err)
+	}
+
+	fmt.Printf("Downloaded %s to %s.\n", fileName, filePath)
+	return 0
+}
+
+func printInfo(torrent torrent.TorrentMetadata) {
+	fmt.Printf("Tracker URL: %s\n", torrent.Announce)
+	fmt.Printf("Length: %d\n", torrent.Info.Length)
+	fmt.Printf("Info Hash: %x\n", torrent.Info.Hash())
+	fmt.Printf("Piece Length: %d\n", torrent.Info.PieceLength)
+	fmt.Printf("Piece Hashes:\n")
+	pieces := bencode.SplitPiecesIntoHashes(torrent.Info.Pieces)
+	for _, p := range pieces {
+		fmt.Printf("%s\n", p)
+	}
+}
+
+// startListener accepts connections from peers for the download's torrent until ctx is done
+func startListener(ctx context.Context, dl *worker.Downloader) error {
+	listener, err := worker.Listen(fmt.Sprintf(":%d", protocol.LISTEN_PORT))
+	if err != nil {
+		return err
+	}
+	listener.Add(dl)
+	go listener.Run(ctx)
+	return nil
+}
+
+// seedTorrent checks the data at filePath against the torrent and serves it to anyone asking,
+// until interrupted. Returns the exit code
+func seedTorrent(fileName string, filePath string, uploadSlots int) int {
+	torrent, err := decodeFile(fileName)
+	if err != nil {
+		tracerr.PrintSourceColor(err)
+		return 1
+	}
+
+	// opening the storage would create whatever is missing
+	_, err = os.Stat(filePath)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	store, err := storage.Open(filePath, torrent.Info, storage.Options{})
+	if err != nil {
+		fmt.Println("Error opening data:", err)
+		return 1
+	}
+	defer store.Close()
+
+	fmt.Println("Checking data in", filePath)
+	numPieces := len(torrent.Info.Pieces) / 20
+	verified := storage.Recheck(store, torrent.Info)
+	if verified.Count() != numPieces {
+		fmt.Printf("Only %d of %d pieces are intact, download the rest first\n", verified.Count(), numPieces)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	picker := worker.NewSequentialPicker(numPieces)
+	for i := 0; i < numPieces; i++ {
+		picker.Done(i)
+	}
+	dl := worker.NewDownloader(nil, &torrent, picker, store)
+	dl.Verified = verified
+	dl.Seed = true
+	dl.Choker.Slots = uploadSlots
+
+	err = startListener(ctx, dl)
+	if err != nil {
+		fmt.Println("Error listening for peers:", err)
+		return 1
+	}
+
+	// the announce puts us on the tracker's list, the peers it returns may want what we have
+	peersList, err := protocol.GetPeers(torrent)
+	if err != nil {
+		fmt.Println("Error announcing to tracker:", err)
+	}
+	swarm := worker.NewSwarm(torrent.Info.Hash(), worker.TARGET_PEERS, dl.Bans)
+	swarm.AddCandidates(peersList, worker.SourceTracker)
+	dl.Swarm = swarm
+	go swarm.Run(ctx)
+	startLSD(ctx, torrent.Info.Hash(), swarm)
+
+	fmt.Printf("Seeding %s from %s on port %d, interrupt to stop\n", fileName, filePath, protocol.LISTEN_PORT)
+	err = dl.Run(ctx)
+	if err != nil {
+		fmt.Println("Error seeding:", err)
+		return 1
+	}
+
+	fmt.Printf("Uploaded %d bytes.\n", dl.Uploaded)
+	return 0
+}
+
+// startLSD feeds peers announcing the torrent on the local network into the swarm, until ctx is done.
+// It announces LISTEN_PORT, so the listener has to be up first
+func startLSD(ctx context.Context, infoHash []byte, swarm *worker.Swarm) {
+	service, err := lsd.New(lsd.LSD_GROUP, protocol.LISTEN_PORT)
+	if err != nil {
+		util.DebugLog("local service discovery unavailable: ", err)
+		return
+	}
+
+	service.Add(infoHash, func(addr string) {
+		swarm.AddCandidates([]string{addr}, worker.SourceLSD)
+	})
+	go func() {
+		service.Run(ctx)
+		service.Close()
+	}()
+}
+
+// fetchMagnet parses a magnet link and fetches its info dictionary from the swarm,
+// asking several peers at once. Returns the peers found along the way too.
+// download is set when the torrent is downloaded next, so we announce ourselves to the DHT
+func fetchMagnet(magnetLink string, download bool) (*extension.Magnet, torrent.TorrentMetadata, []string, error) {
+	m := extension.NewMagnet(magnetLink)
+	err := m.Parse()
+	if err != nil {
+		return nil, torrent.TorrentMetadata{}, nil, fmt.Errorf("parsing magnet link: %v", err)
+	}
+
+	// peers from the link itself are enough if there's no tracker, trackerless links fall back to the DHT
+	peers, err := m.GetPeers()
+	if err != nil {
+		util.DebugLog("no peers from the tracker: ", err)
+	}
+	peers = append(peers, m.Peers...)
+	if len(peers) == 0 {
+		peers, err = dhtPeers(m.InfoHashDecoded, download)
+		if err != nil {
+			return nil, torrent.TorrentMetadata{}, nil, fmt.Errorf("getting peers from the DHT: %v", err)
+		}
+	}
+
+	info, err := extension.FetchMetadataFromPeers(peers, m.InfoHashDecoded, extension.METADATA_PARALLEL)
+	if err != nil {
+		return nil, torrent.TorrentMetadata{}, nil, err
+	}
+	return m, m.TorrentMetadata(info), peers, nil
+}
+
+// dhtStatePath is where the DHT node id and routing table are kept between runs
+func dhtStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "mybittorrent", "dht.dat")
+}
+
+// startDHT joins the DHT through the nodes saved by the last run and the bootstrap routers.
+// The node id is kept too, so we come back to the same neighbourhood
+func startDHT() (*dht.DHT, error) {
+	state, err := dht.Load(dhtStatePath())
+	if err != nil {
+		util.DebugLog("no saved DHT state: ", err)
+		state = dht.State{ID: dht.RandomID()}
+	}
+
+	node, err := dht.New(fmt.Sprintf(":%d", dht.DEFAULT_PORT), state.ID)
+	if err != nil {
+		// the port is taken, e.g. by another client, any will do for lookups
+		node, err = dht.New(":0", state.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = node.Bootstrap(append(state.Addrs(), dht.BOOTSTRAP_NODES...))
+	if err != nil {
+		node.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// stopDHT saves the routing table for next time and closes the node
+func stopDHT(node *dht.DHT) {
+	path := dhtStatePath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = node.Save(path)
+	}
+	if err != nil {
+		util.DebugLog("saving DHT state failed: ", err)
+	}
+	node.Close()
+}
+
+// dhtPeers looks up peers of a torrent in the DHT. With announce the closest nodes are told
+// we are a peer too on LISTEN_PORT, for when we are about to download it
+func dhtPeers(infoHash []byte, announce bool) ([]string, error) {
+	id, err := dht.IDFromBytes(infoHash)
+	if err != nil {
+		return nil, fmt.Errorf("DHT needs a v1 info hash: %v", err)
+	}
+
+	node, err := startDHT()
+	if err != nil {
+		return nil, err
+	}
+	defer stopDHT(node)
+
+	if announce {
+		return node.Announce(id, protocol.LISTEN_PORT)
+	}
+	return node.Peers(id)
+}
+
 func main() {
 	command := os.Args[1]
 
@@ -99,17 +671,14 @@ func main() {
 			return
 		}
 
-		// Now you can use the struct
-		fmt.Printf("Tracker URL: %s\n", torrent.Announce)
-		fmt.Printf("Length: %d\n", torrent.Info.Length)
-		fmt.Printf("Info Hash: %s\n", bencode.CalculateInfoHash(torrent))
-		fmt.Printf("Piece Length: %d\n", torrent.Info.PieceLength)
-		fmt.Printf("Piece Hashes:\n")
-		pieces := bencode.SplitPiecesIntoHashes(torrent.Info.Pieces)
-		for _, p := range pieces {
-			fmt.Printf("%s\n", p)
-		}
+		printInfo(torrent)
 	} else if command == "peers" {
+		if len(os.Args) < 3 || len(os.Args) > 4 || (len(os.Args) == 4 && os.Args[3] != "--lsd") {
+			fmt.Println("Invalid command. Usage: peers <torrent_file> [--lsd]")
+			fmt.Printf("--lsd announces on the local network and listens for %v. Only clients like this one announce back,\n", lsd.LOOKUP_WAIT)
+			fmt.Printf("others following BEP 14 are heard from when they announce on their own, every %v\n", lsd.ANNOUNCE_INTERVAL)
+			return
+		}
 		fileName := os.Args[2]
 
 		torrent, err := decodeFile(fileName)
@@ -118,15 +687,104 @@ func main() {
 			return
 		}
 
+		// --lsd adds peers on the local network, found with a multicast announce.
+		// BEP 14 has no replies, only clients announcing back like ours are found within LOOKUP_WAIT
+		withLSD := len(os.Args) > 3
+
 		peersList, err := protocol.GetPeers(torrent)
-		if err != nil {
+		if err != nil && !withLSD {
 			tracerr.PrintSourceColor(err)
 			return
 		}
+		if err != nil {
+			fmt.Println("Error getting peers from tracker:", err)
+		}
+
+		if withLSD {
+			lsdPeers, err := lsd.Lookup(lsd.LSD_GROUP, protocol.LISTEN_PORT, torrent.Info.Hash(), lsd.LOOKUP_WAIT)
+			if err != nil {
+				fmt.Println("Error with local service discovery:", err)
+			} else if len(lsdPeers) == 0 {
+				fmt.Printf("No local peers answered within %v, others may only announce every %v\n", lsd.LOOKUP_WAIT, lsd.ANNOUNCE_INTERVAL)
+			}
+			peersList = append(peersList, lsdPeers...)
+		}
+
+		for _, p := range peersList {
+			fmt.Println(p)
+		}
+	} else if command == "dht_peers" {
+		target := os.Args[2]
+
+		// a magnet link or a hex info hash
+		var infoHash []byte
+		if strings.HasPrefix(target, "magnet:") {
+			m := extension.NewMagnet(target)
+			err := m.Parse()
+			if err != nil {
+				fmt.Println("Error parsing magnet link:", err)
+				return
+			}
+			infoHash = m.InfoHashDecoded
+		} else {
+			id, err := dht.ParseID(target)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			infoHash = id[:]
+		}
+
+		peersList, err := dhtPeers(infoHash, false)
+		if err != nil {
+			fmt.Println("Error looking up peers:", err)
+			os.Exit(1)
+		}
 
 		for _, p := range peersList {
 			fmt.Println(p)
 		}
+	} else if command == "dht_stats" {
+		node, err := startDHT()
+		if err != nil {
+			fmt.Println("Error joining the DHT:", err)
+			os.Exit(1)
+		}
+		defer stopDHT(node)
+
+		// a lookup of a random id shows how well queries get answered
+		_, err = node.FindClosest(dht.RandomID())
+		if err != nil {
+			fmt.Println("Error looking up a random id:", err)
+		}
+
+		fmt.Println("Node ID:", node.ID)
+		fmt.Println("Listening on:", node.Addr())
+		fmt.Println("Routing table:", node.Table.Len(), "nodes")
+		fmt.Println("Buckets:")
+		for i, n := range node.Table.Buckets() {
+			if n > 0 {
+				fmt.Printf("  %3d: %d\n", i, n)
+			}
+		}
+
+		stats := node.Stats()
+		methods := make([]string, 0, len(stats.Sent))
+		for method := range stats.Sent {
+			methods = append(methods, method)
+		}
+		for method := range stats.Received {
+			if _, ok := stats.Sent[method]; !ok {
+				methods = append(methods, method)
+			}
+		}
+		sort.Strings(methods)
+		fmt.Println("Queries (sent/received):")
+		for _, method := range methods {
+			fmt.Printf("  %-14s %d/%d\n", method, stats.Sent[method], stats.Received[method])
+		}
+		fmt.Println("Timeouts:", stats.Timeouts)
+		fmt.Println("Errors:", stats.Errors)
 	} else if command == "handshake" {
 		fileName := os.Args[2]
 
@@ -189,14 +847,15 @@ func main() {
 				return
 			}
 
-			file, err := os.Create(filePath)
+			// the output holds just this one piece
+			store, err := storage.NewFileStorage(filePath, len(data), len(data), storage.AllocGrow)
 			if err != nil {
 				fmt.Println("Error creating file:", err)
 				return
 			}
-			defer file.Close()
+			defer store.Close()
 
-			_, err = file.Write(data)
+			_, err = store.WriteAt(0, data, 0)
 			if err != nil {
 				fmt.Println("Error writing to file:", err)
 				return
@@ -210,7 +869,14 @@ func main() {
 		}
 	} else if command == "download" {
 		option := os.Args[2]
-		if option == "-o" && len(os.Args) == 5 {
+		if option == "-o" && len(os.Args) == 5 && os.Args[3] == "-" {
+			err := streamDownload(os.Args[4])
+			if err != nil {
+				util.Logger.Println("Error downloading:", err)
+				os.Exit(1)
+			}
+			return
+		} else if option == "-o" && len(os.Args) == 5 {
 			filePath := os.Args[3]
 			fileName := os.Args[4]
 
@@ -238,34 +904,35 @@ func main() {
 				return
 			}
 
-			data := protocol.Download(conn, torrent)
-			if (data == nil) || (len(data) == 0) {
-				fmt.Println("Error downloading data")
-				return
-			}
-
-			file, err := os.Create(filePath)
+			store, err := storage.Open(filePath, torrent.Info, storage.Options{})
 			if err != nil {
 				fmt.Println("Error creating file:", err)
 				return
 			}
-			defer file.Close()
+			defer store.Close()
 
-			_, err = file.Write(data)
+			err = protocol.Download(conn, torrent, func(index int, data []byte) error {
+				_, err := store.WriteAt(index, data, 0)
+				return err
+			})
 			if err != nil {
-				fmt.Println("Error writing to file:", err)
+				fmt.Println("Error downloading data:", err)
 				return
 			}
 
 			fmt.Printf("Downloaded %s to %s.\n", fileName, filePath)
 			return
 		} else {
-			fmt.Println("Invalid command. Usage: download -o <file_path> <torrent_file>")
+			fmt.Println("Invalid command. Usage: download -o <file_path|-> <torrent_file>")
 			return
 		}
 	} else if command == "download_x" {
 		option := os.Args[2]
-		if option == "-o" && len(os.Args) == 5 {
+		opts, optsErr := downloadOptions{}, fmt.Errorf("missing arguments")
+		if len(os.Args) >= 5 {
+			opts, optsErr = parseDownloadOptions(os.Args[5:])
+		}
+		if option == "-o" && optsErr == nil {
 			filePath := os.Args[3]
 			fileName := os.Args[4]
 
@@ -275,72 +942,36 @@ func main() {
 				return
 			}
 
-			peersList, err := protocol.GetPeers(torrent)
-			if err != nil {
-				tracerr.PrintSourceColor(err)
-				return
-			}
-
-			validPeers := protocol.InitPeers(peersList, torrent)
-			fmt.Printf("Downloading %s from %v peers\n", fileName, validPeers)
-
-			// initiatilizing ctx
-			ctx, cancel := context.WithCancel(context.Background())
-
-			sigCh := make(chan os.Signal, 1)
-			defer close(sigCh)
-
-			signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT)
-			go func() {
-				// wait until receiving the signal
-				<-sigCh
-				cancel()
-			}()
-
-			dl := worker.NewDownloader(validPeers, torrent.Info.Length)
-			d := worker.NewDispatcher(dl, len(validPeers), 5) // maxWorkers equals valid peers for now
-
-			// split the file into pieces
-			piecesHash := bencode.SplitPiecesIntoHashes(torrent.Info.Pieces)
-
-			// add a job for each piece
-			for i, pieceHash := range piecesHash {
-				job := &worker.DownloadPieceJob{
-					PieceIndex: i,
-					Torrent:    &torrent,
-					Hash:       pieceHash,
-				}
-				d.Add(job)
-			}
-
-			// start the dispatcher
-			d.Start(ctx)
-
-			// wait for all the jobs to finish
-			d.Wait()
-
-			// close any open connections
-			dl.CloseConnections()
-
-			file, err := os.Create(filePath)
-			if err != nil {
-				fmt.Println("Error creating file:", err)
-				return
-			}
-			defer file.Close()
-
-			_, err = file.Write(dl.FullData)
-			if err != nil {
-				fmt.Println("Error writing to file:", err)
-				return
+			exitCode := downloadTorrent(torrent, fileName, filePath, opts, nil)
+			if exitCode != 0 {
+				os.Exit(exitCode)
 			}
-
-			fmt.Printf("Downloaded %s to %s.\n", fileName, filePath)
 			return
 		} else {
-			fmt.Println("Invalid command. Usage: download_x -o <file_path> <torrent_file>")
+			fmt.Println("Invalid command. Usage: download_x -o <file_path> <torrent_file> [--sequential] [--only <glob>] [--skip <glob>] [--priority <glob>=<skip|low|normal|high>] [--alloc <grow|sparse|full|temp>] [--cache <MiB>] [--upload-slots <n>]")
+			if optsErr != nil {
+				fmt.Println(optsErr)
+			}
 			return
 		}
+	} else if command == "seed" {
+		var err error
+		uploadSlots := worker.UPLOAD_SLOTS
+		if len(os.Args) == 6 && os.Args[4] == "--upload-slots" {
+			uploadSlots, err = parseUploadSlots(os.Args[5])
+		} else if len(os.Args) != 4 {
+			err = fmt.Errorf("missing or unknown arguments")
+		}
+		if err != nil {
+			fmt.Println("Invalid command. Usage: seed <torrent_file> <path> [--upload-slots <n>]")
+			fmt.Println(err)
+			return
+		}
+
+		exitCode := seedTorrent(os.Args[2], os.Args[3], uploadSlots)
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
 	} else if command == "magnet_parse" {
 		magnetLink := os.Args[2]
 
@@ -353,6 +984,82 @@ func main() {
 
 		fmt.Println("Tracker URL:", m.URL)
 		fmt.Println("Info Hash:", m.InfoHash)
+	} else if command == "magnet_info" {
+		magnetLink := os.Args[2]
+
+		_, torrent, _, err := fetchMagnet(magnetLink, false)
+		if err != nil {
+			fmt.Println("Error fetching metadata:", err)
+			os.Exit(1)
+		}
+
+		printInfo(torrent)
+	} else if command == "magnet_to_torrent" {
+		if len(os.Args) != 5 || os.Args[3] != "-o" {
+			fmt.Println("Invalid command. Usage: magnet_to_torrent <magnet_link> -o <torrent_file>")
+			return
+		}
+		magnetLink := os.Args[2]
+		filePath := os.Args[4]
+
+		m, torrent, _, err := fetchMagnet(magnetLink, false)
+		if err != nil {
+			fmt.Println("Error fetching metadata:", err)
+			os.Exit(1)
+		}
+
+		content, err := m.TorrentFile(torrent.Info)
+		if err != nil {
+			fmt.Println("Error building torrent file:", err)
+			os.Exit(1)
+		}
+		err = os.WriteFile(filePath, content, 0644)
+		if err != nil {
+			fmt.Println("Error writing torrent file:", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Saved %s to %s.\n", torrent.Info.Name, filePath)
+	} else if command == "magnet_download" {
+		opts, optsErr := downloadOptions{}, fmt.Errorf("missing arguments")
+		if len(os.Args) >= 5 && os.Args[2] == "-o" {
+			opts, optsErr = parseDownloadOptions(os.Args[5:])
+		}
+		if optsErr != nil {
+			fmt.Println("Invalid command. Usage: magnet_download -o <file_path> <magnet_link> [download_x options]")
+			fmt.Println(optsErr)
+			return
+		}
+		filePath := os.Args[3]
+		magnetLink := os.Args[4]
+
+		m, torrent, peers, err := fetchMagnet(magnetLink, true)
+		if err != nil {
+			fmt.Println("Error fetching metadata:", err)
+			os.Exit(1)
+		}
+
+		// the files the link asks for, unless they were picked on the command line
+		if m.Select != nil && len(torrent.Info.Files) > 0 && !opts.picksFiles() {
+			selected := 0
+			for i := range torrent.Info.Files {
+				if m.Selects(i) {
+					selected++
+				}
+			}
+			if selected == 0 {
+				fmt.Printf("The magnet link selects none of the %d files\n", len(torrent.Info.Files))
+				os.Exit(1)
+			}
+			opts.selected = m.Selects
+		}
+		opts.webSeeds = m.WebSeeds
+
+		// the peers that were asked for the metadata are a good start, the tracker is asked again anyway
+		exitCode := downloadTorrent(torrent, torrent.Info.Name, filePath, opts, peers)
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
 	} else if command == "magnet_handshake" {
 		magnetLink := os.Args[2]
 
@@ -375,10 +1082,24 @@ func main() {
 		defer conn.Close()
 
 		response := protocol.SendTCPHandshake(conn, []byte(m.InfoHashDecoded), true)
+		if len(response) != 68 {
+			fmt.Println("Error: incomplete handshake")
+			return
+		}
 		handshake := protocol.DestructureHandshakeResponse(response)
 
 		fmt.Printf("Peer ID: %x\n", string(handshake.PeerId))
 
+		if !handshake.SupportsExtensions() {
+			return
+		}
+
+		extended, err := extension.Handshake(conn)
+		if err != nil {
+			fmt.Println("Error in extension handshake:", err)
+			return
+		}
+		fmt.Printf("Peer Metadata Extension ID: %d\n", extended.M[extension.UT_METADATA])
 	} else {
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
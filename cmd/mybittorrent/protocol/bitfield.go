@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Bitfield represents the pieces a peer has
+// the high bit in the first byte corresponds to piece index 0
+type Bitfield []byte
+
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// UnmarshalBitfield validates the payload of a bitfield message against the number of pieces
+func UnmarshalBitfield(payload []byte, numPieces int) (Bitfield, error) {
+	if len(payload) != (numPieces+7)/8 {
+		return nil, fmt.Errorf("invalid bitfield length %d for %d pieces", len(payload), numPieces)
+	}
+
+	bf := make(Bitfield, len(payload))
+	copy(bf, payload)
+
+	// spare bits at the end must be cleared
+	for i := numPieces; i < len(bf)*8; i++ {
+		if bf.Has(i) {
+			return nil, fmt.Errorf("spare bit %d set in bitfield", i)
+		}
+	}
+
+	return bf, nil
+}
+
+func (bf Bitfield) Has(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-uint(index%8))&1 != 0
+}
+
+func (bf Bitfield) Set(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - uint(index%8))
+}
+
+func (bf Bitfield) Clear(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << (7 - uint(index%8))
+}
+
+// Count returns the number of pieces set
+func (bf Bitfield) Count() int {
+	count := 0
+	for _, b := range bf {
+		count += bits.OnesCount8(b)
+	}
+	return count
+}
+
+// Marshal returns a copy of the bitfield suitable as a bitfield message payload
+func (bf Bitfield) Marshal() []byte {
+	payload := make([]byte, len(bf))
+	copy(payload, bf)
+	return payload
+}
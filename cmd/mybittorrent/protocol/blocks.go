@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// MAX_PIPELINE is the number of block requests kept outstanding on a connection
+const MAX_PIPELINE = 5
+
+// MAX_REQUEST_LENGTH is the largest block we serve, peers asking for more are dropped
+const MAX_REQUEST_LENGTH = 128 * 1024
+
+// MAX_MESSAGE_LENGTH bounds the length prefix of any message but bitfields and extended ones,
+// the largest being a piece message carrying a block we asked for
+const MAX_MESSAGE_LENGTH = 1 + 8 + BLOCK_LENGTH
+
+// MAX_BITFIELD_LENGTH is enough for torrents of up to 2M pieces
+const MAX_BITFIELD_LENGTH = 1 + 1<<18
+
+// MAX_EXTENDED_LENGTH leaves room for ut_metadata pieces and large PEX or handshake dictionaries
+const MAX_EXTENDED_LENGTH = 1 + 1<<20
+
+// returned by readMessage when nothing valid could be read
+const msgInvalid uint8 = 0xff
+
+// maxLength is the longest message with the given id we are willing to read
+func maxLength(id byte) uint32 {
+	switch id {
+	case MsgBitfield:
+		return MAX_BITFIELD_LENGTH
+	case MsgExtended:
+		return MAX_EXTENDED_LENGTH
+	default:
+		return MAX_MESSAGE_LENGTH
+	}
+}
+
+// readMessage reads one length prefixed message, skipping keep-alives.
+// The length comes straight from the peer, so it is checked before anything gets allocated
+func readMessage(conn net.Conn) (byte, []byte, error) {
+	for {
+		buffer := make([]byte, 5)
+		_, err := io.ReadFull(conn, buffer[:4])
+		if err != nil {
+			return msgInvalid, nil, err
+		}
+		messageLength := binary.BigEndian.Uint32(buffer)
+		util.DebugLog("tcp message length to receive: ", messageLength)
+
+		if messageLength == 0 {
+			// keep-alive
+			continue
+		}
+
+		_, err = io.ReadFull(conn, buffer[4:])
+		if err != nil {
+			return msgInvalid, nil, err
+		}
+		id := buffer[4]
+		if messageLength > maxLength(id) {
+			return msgInvalid, nil, fmt.Errorf("message %d of %d bytes is too long", id, messageLength)
+		}
+
+		payload := make([]byte, messageLength-1)
+		_, err = io.ReadFull(conn, payload) // conn.Read doesnt work here; it might read lesser bytes than expected
+		if err != nil {
+			return msgInvalid, nil, err
+		}
+
+		return id, payload, nil
+	}
+}
+
+// sendBlockMessage sends a request or cancel, they share the same layout
+func sendBlockMessage(conn net.Conn, id uint8, index int, begin int, length int) error {
+	_, err := conn.Write(blockMessage(id, index, begin, length).Encode())
+	return err
+}
+
+// PieceRequest describes the download of one piece over a single connection
+type PieceRequest struct {
+	Index  int
+	Length int
+	// OnHave receives have messages that arrive in between, may be nil
+	OnHave func(index int)
+	// OnBlock is called for every block as it arrives
+	OnBlock func(begin int, block []byte)
+}
+
+// DownloadBlocks requests the blocks of a piece, keeping up to MAX_PIPELINE requests in flight
+func DownloadBlocks(conn net.Conn, req PieceRequest) error {
+	// outstanding requests, keyed by begin offset
+	outstanding := make(map[int]int)
+	next := 0
+
+	for next < req.Length || len(outstanding) > 0 {
+		// fill up the pipeline
+		for len(outstanding) < MAX_PIPELINE && next < req.Length {
+			begin := next
+			blockLength := BLOCK_LENGTH
+			if begin+blockLength > req.Length {
+				blockLength = req.Length - begin
+			}
+			next += blockLength
+
+			err := sendBlockMessage(conn, MsgRequest, req.Index, begin, blockLength)
+			if err != nil {
+				return fmt.Errorf("Error sending request message: %v", err)
+			}
+			outstanding[begin] = blockLength
+		}
+
+		id, content, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch id {
+		case MsgHave:
+			if req.OnHave != nil && len(content) == 4 {
+				req.OnHave(int(binary.BigEndian.Uint32(content)))
+			}
+		case MsgChoke:
+			return fmt.Errorf("choked while downloading piece %d", req.Index)
+		case MsgPiece:
+			index, begin, block, err := ParsePieceMessage(content)
+			if err != nil {
+				return err
+			}
+
+			// a late or unexpected block, drop it
+			if index != req.Index || outstanding[begin] != len(block) {
+				util.DebugLog(fmt.Sprintf("Dropping unexpected block %d:%d", index, begin))
+				continue
+			}
+
+			delete(outstanding, begin)
+			req.OnBlock(begin, block)
+		default:
+			util.DebugLog("Ignoring message while downloading: ", id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Message is a single peer wire message without its length prefix
+type Message struct {
+	Id      uint8
+	Payload []byte
+}
+
+// ReadMessage reads the next message from the connection, skipping keep-alives
+func ReadMessage(conn net.Conn) (Message, error) {
+	id, payload, err := readMessage(conn)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Id: id, Payload: payload}, nil
+}
+
+func (m Message) Encode() []byte {
+	msg := make([]byte, 4, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(msg, uint32(1+len(m.Payload)))
+	msg = append(msg, m.Id)
+	msg = append(msg, m.Payload...)
+	return msg
+}
+
+func blockMessage(id uint8, index int, begin int, length int) Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return Message{Id: id, Payload: payload}
+}
+
+func NewRequestMessage(index int, begin int, length int) Message {
+	return blockMessage(MsgRequest, index, begin, length)
+}
+
+func NewCancelMessage(index int, begin int, length int) Message {
+	return blockMessage(MsgCancel, index, begin, length)
+}
+
+// NewPieceMessage carries a block we serve, in answer to a request
+func NewPieceMessage(index int, begin int, block []byte) Message {
+	payload := make([]byte, 8, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	return Message{Id: MsgPiece, Payload: append(payload, block...)}
+}
+
+// ParseRequestMessage splits a request or cancel into its index, begin offset and length
+func ParseRequestMessage(payload []byte) (int, int, int, error) {
+	if len(payload) != 12 {
+		return -1, -1, -1, fmt.Errorf("invalid request message length %d", len(payload))
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	length := int(binary.BigEndian.Uint32(payload[8:12]))
+	return index, begin, length, nil
+}
+
+func NewHaveMessage(index int) Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return Message{Id: MsgHave, Payload: payload}
+}
+
+func ParseHaveMessage(payload []byte) (int, error) {
+	if len(payload) != 4 {
+		return -1, fmt.Errorf("invalid have message length %d", len(payload))
+	}
+	return int(binary.BigEndian.Uint32(payload)), nil
+}
+
+// ParsePieceMessage splits a piece message into its index, begin offset and block data
+func ParsePieceMessage(payload []byte) (int, int, []byte, error) {
+	if len(payload) < 8 {
+		return -1, -1, nil, fmt.Errorf("piece message too short")
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	return index, begin, payload[8:], nil
+}
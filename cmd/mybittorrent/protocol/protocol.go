@@ -2,11 +2,12 @@ package protocol
 
 import (
 	"bytes"
-	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
@@ -16,11 +17,14 @@ import (
 const MY_PEER_ID = "00112233445566778899"
 const BLOCK_LENGTH = 16384 // 16KiB, 2^14
 
+// LISTEN_PORT is the port we tell trackers and the local network to reach us on
+const LISTEN_PORT = 6881
+
 func GetPeers(torrent torrent.TorrentMetadata) ([]string, error) {
-	infoHash := bencode.CalculateInfoHash(torrent)
+	infoHash := hex.EncodeToString(torrent.Info.Hash())
 
 	url := fmt.Sprintf("%s?info_hash=%s&peer_id=%s&port=%d&uploaded=0&downloaded=0&left=92063&compact=1",
-		torrent.Announce, UrlEncodeWithConversion(infoHash), "00112233445566778899", 6881)
+		torrent.Announce, UrlEncodeWithConversion(infoHash), "00112233445566778899", LISTEN_PORT)
 
 	response, err := http.Get(url)
 	if err != nil {
@@ -29,7 +33,7 @@ func GetPeers(torrent torrent.TorrentMetadata) ([]string, error) {
 	defer response.Body.Close()
 	body, err := io.ReadAll(response.Body)
 	if err != nil {
-		fmt.Println("Error reading response body:", err)
+		util.Logger.Println("Error reading response body:", err)
 	}
 
 	util.DebugLog("Response body: ", body)
@@ -73,13 +77,14 @@ func GetPeers(torrent torrent.TorrentMetadata) ([]string, error) {
 }
 
 func DestructureHandshakeResponse(response []byte) Handshake {
-	return Handshake{
+	handshake := Handshake{
 		length:   response[0],
 		protocol: string(response[1:20]),
-		resv:     [8]byte{},
 		info:     response[28:48],
 		PeerId:   response[48:68],
 	}
+	copy(handshake.resv[:], response[20:28])
+	return handshake
 }
 
 // net.Conn is an interface
@@ -88,46 +93,50 @@ func EstablishTCPConnection(peerIpPort string) *net.TCPConn {
 	// Establish a TCP connection
 	conn, err := net.Dial("tcp", peerIpPort)
 	if err != nil {
-		fmt.Println("Error connecting:", err)
+		util.Logger.Println("Error connecting:", err)
 	}
 
 	// Type assert the net.Conn to *net.TCPConn
 	tcpConn, ok := conn.(*net.TCPConn)
 	if !ok {
-		fmt.Println("Error: Not a TCP connection")
+		util.Logger.Println("Error: Not a TCP connection")
 		return nil
 	}
 
 	return tcpConn
 }
 
-func SendTCPHandshake(conn *net.TCPConn, infoHash []byte, isExtension bool) []byte {
+func newHandshake(infoHash []byte, isExtension bool) Handshake {
 	resv := [8]byte{}
 	if isExtension {
 		// set 20th bit from the right to zero for EXTENSION
 		resv[5] = 0x10
 	}
 
-	handshakeMessage := Handshake{
+	return Handshake{
 		length:   byte(19),
 		protocol: "BitTorrent protocol",
 		resv:     resv,
 		info:     infoHash,
 		PeerId:   []byte(MY_PEER_ID),
-	}.encode()
+	}
+}
+
+func SendTCPHandshake(conn *net.TCPConn, infoHash []byte, isExtension bool) []byte {
+	handshakeMessage := newHandshake(infoHash, isExtension).encode()
 
 	a, err := conn.Write(handshakeMessage)
 	util.DebugLog("handshake message sent length: ", a)
 	if err != nil {
-		fmt.Println("Error sending handshake:", err)
+		util.Logger.Println("Error sending handshake:", err)
 	}
 
 	response := make([]byte, 68)
 	// Read the handshake response from the server
-	n, err := conn.Read(response)
+	n, err := io.ReadFull(conn, response)
 	util.DebugLog("handshake response received length: ", n)
 	if err != nil {
-		fmt.Println("Error receiving handshake response:", err)
+		util.Logger.Println("Error receiving handshake response:", err)
 	}
 
 	// response will contain the entire protocol message
@@ -137,118 +146,180 @@ func SendTCPHandshake(conn *net.TCPConn, infoHash []byte, isExtension bool) []by
 }
 
 func getMsgFromConn(conn net.Conn) (byte, []byte) {
-	buffer := make([]byte, 4)
-	_, err := conn.Read(buffer)
+	id, content, err := readMessage(conn)
 	if err != nil {
-		fmt.Println("Error reading message:", err)
+		util.Logger.Println("Error reading message:", err)
+		return msgInvalid, nil
 	}
-	messageLength := binary.BigEndian.Uint32(buffer)
-	util.DebugLog("tcp message length to receive: ", messageLength)
 
-	if messageLength == 0 {
-		fmt.Println("Connection closed by peer")
-	}
-	buffer = make([]byte, messageLength)
-	_, err = io.ReadFull(conn, buffer) // conn.Read doesnt work here; it might read lesser bytes than expected
-	// checking the content after reading with conn.Read shows tonnes of 0 padding at the end, means data is not being read fully
+	return id, content
+}
+
+// HANDSHAKE_TIMEOUT bounds dialing a peer and the handshake exchange
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// ConnectPeer dials a peer and completes the handshake, making sure it serves the same torrent
+func ConnectPeer(peerIpPort string, infoHash []byte, isExtension bool) (*Peer, error) {
+	conn, err := net.DialTimeout("tcp", peerIpPort, HANDSHAKE_TIMEOUT)
 	if err != nil {
-		fmt.Println("Error reading message:", err)
+		return nil, err
 	}
 
-	id := buffer[0]
-	content := buffer[1:]
-	return id, content
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Not a TCP connection")
+	}
+
+	tcpConn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	response := SendTCPHandshake(tcpConn, infoHash, isExtension)
+	tcpConn.SetDeadline(time.Time{})
+
+	if len(response) != 68 {
+		tcpConn.Close()
+		return nil, fmt.Errorf("incomplete handshake from %s", peerIpPort)
+	}
+
+	handshake := DestructureHandshakeResponse(response)
+	if !bytes.Equal(handshake.info, infoHash) {
+		tcpConn.Close()
+		return nil, fmt.Errorf("peer %s serves a different info hash", peerIpPort)
+	}
+
+	return &Peer{
+		Conn:       tcpConn, // needs to be closed later on
+		Addr:       peerIpPort,
+		Id:         fmt.Sprintf("%x", handshake.PeerId),
+		Stats:      NewPeerStats(),
+		Extensions: isExtension && handshake.SupportsExtensions(),
+	}, nil
 }
 
-func InitPeers(peersList []string, torrent torrent.TorrentMetadata) []Peer {
-	var peers []Peer
-	for _, peer := range peersList {
-		conn := EstablishTCPConnection(peer)
+// AcceptPeer completes the handshake of a connection a peer made to us. known reports whether we serve an info hash,
+// the connection is closed if not. Returns the peer and the info hash it asked for
+func AcceptPeer(conn *net.TCPConn, known func(infoHash []byte) bool) (*Peer, []byte, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+
+	// the peer speaks first, we only answer for torrents we have
+	response := make([]byte, 68)
+	_, err := io.ReadFull(conn, response)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("incomplete handshake: %v", err)
+	}
+
+	handshake := DestructureHandshakeResponse(response)
+	if handshake.length != 19 || handshake.protocol != "BitTorrent protocol" {
+		conn.Close()
+		return nil, nil, fmt.Errorf("not a BitTorrent handshake")
+	}
+	if !known(handshake.info) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unknown info hash %x", handshake.info)
+	}
 
-		response := SendTCPHandshake(conn, torrent.Info.Hash(), false)
+	_, err = conn.Write(newHandshake(handshake.info, true).encode())
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Error sending handshake: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &Peer{
+		Conn:       conn,
+		Addr:       conn.RemoteAddr().String(),
+		Id:         fmt.Sprintf("%x", handshake.PeerId),
+		Stats:      NewPeerStats(),
+		Extensions: handshake.SupportsExtensions(),
+		Incoming:   true,
+	}, handshake.info, nil
+}
 
-		if (response != nil) && len(response) != -1 && (conn != nil) {
-			peers = append(peers, Peer{
-				Conn: conn, // needs to be closed later on
-				Id:   fmt.Sprintf("%x", DestructureHandshakeResponse(response).PeerId),
-			})
+func InitPeers(peersList []string, torrent torrent.TorrentMetadata) []*Peer {
+	var peers []*Peer
+	for _, peer := range peersList {
+		p, err := ConnectPeer(peer, torrent.Info.Hash(), false)
+		if err != nil {
+			util.Logger.Println("Error connecting to peer:", err)
+			continue
 		}
+
+		peers = append(peers, p)
 	}
 
 	return peers
 }
 
-func DownloadInit(conn *net.TCPConn) error {
+// DownloadInit waits for the peer to unchoke us, collecting the pieces it advertises along the way
+func DownloadInit(conn *net.TCPConn, numPieces int) (Bitfield, error) {
+	bitfield := NewBitfield(numPieces)
+
 	// wait for the first message from the peer
-	id, _ := getMsgFromConn(conn)
-	if id != 5 {
-		return fmt.Errorf("Expected bitfield message, got something else")
+	// a peer with no pieces may skip the bitfield and only send haves
+	id, content := getMsgFromConn(conn)
+	switch id {
+	case MsgBitfield:
+		bf, err := UnmarshalBitfield(content, numPieces)
+		if err != nil {
+			return nil, err
+		}
+		bitfield = bf
+	case MsgHave:
+		index, err := ParseHaveMessage(content)
+		if err != nil {
+			return nil, err
+		}
+		bitfield.Set(index)
+	default:
+		return nil, fmt.Errorf("Expected bitfield message, got %d", id)
 	}
 
 	// show interested
 	interestedMessage := PeerMessage{
-		Length: 5,
-		Id:     byte(2),
+		Length: 1,
+		Id:     MsgInterested,
 	}.encode()
 	_, err := conn.Write(interestedMessage)
 	if err != nil {
-		return fmt.Errorf("Error sending interested message: %s", err.Error())
+		return nil, fmt.Errorf("Error sending interested message: %s", err.Error())
 	}
 
 	util.DebugLog("Sent interested message")
 
-	id, _ = getMsgFromConn(conn)
-	if id != 1 {
-		return fmt.Errorf("Expected unchoke message, got something else")
-	}
-
-	return nil
-}
-
-func RequestPiece(conn net.Conn, torrentMetadata *torrent.TorrentMetadata, pieceIndex int) []byte {
-	var pieceLengthToRetrive int
-	length := torrentMetadata.Info.Length
-	pieceLength := torrentMetadata.Info.PieceLength
-	if (pieceIndex == length/pieceLength) && (length%pieceLength != 0) {
-		// last piece
-		pieceLengthToRetrive = length % pieceLength
-	} else {
-		pieceLengthToRetrive = pieceLength
-	}
-
-	var data []byte
-	for begin := 0; begin < pieceLengthToRetrive; begin += BLOCK_LENGTH {
-		actualBlockLength := BLOCK_LENGTH
-		if begin+BLOCK_LENGTH > pieceLengthToRetrive {
-			actualBlockLength = pieceLengthToRetrive - begin
+	for {
+		id, content = getMsgFromConn(conn)
+		if id == MsgUnchoke {
+			break
 		}
-
-		peerMessage := PeerMessage{
-			Length: 13, // 1 + 4 + 4 + 4
-			Id:     6,
-			index:  uint32(pieceIndex),
-			begin:  uint32(begin),
-			block:  uint32(actualBlockLength),
+		if id != MsgHave {
+			return nil, fmt.Errorf("Expected unchoke message, got %d", id)
 		}
-
-		// send request message
-		var buf bytes.Buffer
-		binary.Write(&buf, binary.BigEndian, peerMessage)
-		_, err := conn.Write(buf.Bytes())
+		index, err := ParseHaveMessage(content)
 		if err != nil {
-			fmt.Println("Error sending request message:", err)
-			return nil
+			return nil, err
 		}
+		bitfield.Set(index)
+	}
 
-		// read the piece
-		id, content := getMsgFromConn(conn)
-		if id != 7 {
-			fmt.Println("Expected piece message, got ", id)
-			return nil
-		}
+	return bitfield, nil
+}
 
-		// write the piece to the file
-		data = append(data, content[8:]...) // first 8 bytes are index and begin; probably better to check
+// RequestPiece downloads a single piece
+// have messages received in between are passed to onHave, which may be nil
+func RequestPiece(conn net.Conn, torrentMetadata *torrent.TorrentMetadata, pieceIndex int, onHave func(index int)) []byte {
+	data := make([]byte, torrentMetadata.Info.PieceSize(pieceIndex))
+
+	err := DownloadBlocks(conn, PieceRequest{
+		Index:  pieceIndex,
+		Length: len(data),
+		OnHave: onHave,
+		OnBlock: func(begin int, block []byte) {
+			copy(data[begin:], block)
+		},
+	})
+	if err != nil {
+		util.Logger.Println("Error requesting piece:", err)
+		return nil
 	}
 
 	return data
@@ -257,39 +328,43 @@ func RequestPiece(conn net.Conn, torrentMetadata *torrent.TorrentMetadata, piece
 func DownloadPiece(conn *net.TCPConn, torrent torrent.TorrentMetadata, pieceIndex int) []byte {
 	// first check pieceIndex validity
 	if pieceIndex > (torrent.Info.Length/torrent.Info.PieceLength) || (pieceIndex < 0) {
-		fmt.Println("Invalid piece index")
+		util.Logger.Println("Invalid piece index")
 		return nil
 	}
 
-	err := DownloadInit(conn)
+	_, err := DownloadInit(conn, len(torrent.Info.Pieces)/20)
 	if err != nil {
-		fmt.Println("Error initializing download:", err)
+		util.Logger.Println("Error initializing download:", err)
 		return nil
 	}
 
-	return RequestPiece(conn, &torrent, pieceIndex)
+	return RequestPiece(conn, &torrent, pieceIndex, nil)
 }
 
-func Download(conn *net.TCPConn, torrent torrent.TorrentMetadata) []byte {
+// Download fetches every piece in order from a single peer, handing each verified piece to onPiece
+func Download(conn *net.TCPConn, torrent torrent.TorrentMetadata, onPiece func(index int, data []byte) error) error {
 	piecesHash := bencode.SplitPiecesIntoHashes(torrent.Info.Pieces)
 
-	data := make([]byte, 0)
-
-	err := DownloadInit(conn)
+	bitfield, err := DownloadInit(conn, len(piecesHash))
 	if err != nil {
-		fmt.Println("Error initializing download:", err)
-		return nil
+		return fmt.Errorf("Error initializing download: %v", err)
 	}
 
 	for i := 0; i < len(piecesHash); i++ {
-		piece := RequestPiece(conn, &torrent, i)
+		if !bitfield.Has(i) {
+			return fmt.Errorf("Peer does not have piece %d", i)
+		}
+
+		piece := RequestPiece(conn, &torrent, i, bitfield.Set)
 		if util.GenerateSHA1Checksum(piece) != piecesHash[i] {
-			fmt.Printf("Sha1 Checksum for Piece %d does not match\n", i)
-			return nil
+			return fmt.Errorf("Sha1 Checksum for Piece %d does not match", i)
 		}
 
-		data = append(data, piece...)
+		err = onPiece(i, piece)
+		if err != nil {
+			return fmt.Errorf("Error writing piece %d: %v", i, err)
+		}
 	}
 
-	return data
+	return nil
 }
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// PeerStats keeps track of how well a peer has been serving us
+type PeerStats struct {
+	mu           sync.Mutex
+	Downloaded   int64 // bytes received in blocks we asked for
+	Uploaded     int64 // bytes of the blocks we served
+	Blocks       int
+	HashFailures int
+	Timeouts     int
+	totalLatency time.Duration
+	Snubbed      bool
+}
+
+func NewPeerStats() *PeerStats {
+	return &PeerStats{}
+}
+
+// AddBlock records a block we asked for along with how long it took since it was requested
+func (s *PeerStats) AddBlock(length int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Downloaded += int64(length)
+	s.Blocks++
+	s.totalLatency += latency
+	s.Snubbed = false
+}
+
+// AvgLatency is the average time between requesting a block and receiving it
+func (s *PeerStats) AvgLatency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Blocks == 0 {
+		return 0
+	}
+	return s.totalLatency / time.Duration(s.Blocks)
+}
+
+// AddUpload records a block we sent to the peer
+func (s *PeerStats) AddUpload(length int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Uploaded += int64(length)
+}
+
+// Transferred returns the bytes received from and sent to the peer so far
+func (s *PeerStats) Transferred() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Downloaded, s.Uploaded
+}
+
+func (s *PeerStats) AddHashFailure() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.HashFailures++
+	return s.HashFailures
+}
+
+// Snub marks the peer as having stopped sending us data
+func (s *PeerStats) Snub() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Timeouts++
+	s.Snubbed = true
+}
+
+// Unsnub gives the peer another chance
+func (s *PeerStats) Unsnub() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Snubbed = false
+}
+
+func (s *PeerStats) IsSnubbed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Snubbed
+}
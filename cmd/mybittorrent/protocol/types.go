@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"net"
+	"net/url"
 )
 
 type Handshake struct {
@@ -13,6 +14,11 @@ type Handshake struct {
 	PeerId   []byte
 }
 
+// SupportsExtensions reports whether the extension protocol bit (BEP 10) is set
+func (handshake Handshake) SupportsExtensions() bool {
+	return handshake.resv[5]&0x10 != 0
+}
+
 func (handshake Handshake) encode() []byte {
 	var msg []byte
 	msg = append(msg, handshake.length)
@@ -31,6 +37,21 @@ type PeerResponse struct {
 	Peers       []byte `json:"peers"`
 }
 
+// peer wire message ids
+const (
+	MsgChoke         uint8 = 0
+	MsgUnchoke       uint8 = 1
+	MsgInterested    uint8 = 2
+	MsgNotInterested uint8 = 3
+	MsgHave          uint8 = 4
+	MsgBitfield      uint8 = 5
+	MsgRequest       uint8 = 6
+	MsgPiece         uint8 = 7
+	MsgCancel        uint8 = 8
+	// BEP 10, the payload starts with the extended message id
+	MsgExtended uint8 = 20
+)
+
 type PeerMessage struct {
 	Length uint32
 	Id     uint8
@@ -49,8 +70,38 @@ func (peerMessage PeerMessage) encode() []byte {
 }
 
 type Peer struct {
-	Conn  *net.TCPConn // need to close at the very end
-	Id    string
-	Retry int
-	Init  bool
+	Conn     *net.TCPConn // need to close at the very end
+	Addr     string       // ip:port we know the peer by
+	Id       string
+	Init     bool
+	Bitfield Bitfield // pieces the peer has, kept up to date with have messages
+	Stats    *PeerStats
+	// Extensions is set if the peer supports the BEP 10 extension protocol
+	Extensions bool
+	// UploadOnly is set while the peer says it won't download anything
+	UploadOnly bool
+	// Incoming is set if the peer connected to us, Addr then has the port it connected from
+	Incoming bool
+	// Interested is set while the peer wants to download from us
+	Interested bool
+	// ListenAddr is where an incoming peer accepts connections, from its extended handshake. Empty if unknown
+	ListenAddr string
+}
+
+// IP of the remote end, used to key bans so that reconnecting on another port doesn't help
+func (p *Peer) IP() string {
+	if p.Conn == nil {
+		// not connected over TCP, like a web seed whose Addr is its URL
+		if host, _, err := net.SplitHostPort(p.Addr); err == nil {
+			return host
+		}
+		if u, err := url.Parse(p.Addr); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+		return p.Addr
+	}
+	if addr, ok := p.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return p.Conn.RemoteAddr().String()
 }
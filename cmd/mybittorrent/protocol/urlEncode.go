@@ -4,6 +4,8 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
 )
 
 // Unreserved characters in URL encoding
@@ -19,7 +21,7 @@ func UrlEncodeWithConversion(input string) string {
 	// Decode the hex string into bytes
 	data, err := hex.DecodeString(input)
 	if err != nil {
-		fmt.Println("Error decoding hex:", err)
+		util.Logger.Println("Error decoding hex:", err)
 		return ""
 	}
 
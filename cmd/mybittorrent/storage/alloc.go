@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+// Allocation decides how output files get their space
+type Allocation string
+
+const (
+	// AllocGrow lets files grow as pieces are written
+	AllocGrow Allocation = "grow"
+	// AllocSparse sets files to their final size up front without reserving any blocks
+	AllocSparse Allocation = "sparse"
+	// AllocFull reserves every block before downloading, so the disk can't fill up midway
+	AllocFull Allocation = "full"
+	// AllocTemp downloads into PART_SUFFIX files that are renamed once complete
+	AllocTemp Allocation = "temp"
+)
+
+// PART_SUFFIX marks files still being downloaded with AllocTemp
+const PART_SUFFIX = ".part"
+
+func ParseAllocation(name string) (Allocation, error) {
+	switch a := Allocation(name); a {
+	case AllocGrow, AllocSparse, AllocFull, AllocTemp:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown allocation %q, expected grow, sparse, full or temp", name)
+}
+
+// Options tunes how Open lays out a torrent on disk
+type Options struct {
+	// Skip lists the files of a multi file torrent that aren't wanted, may be nil
+	Skip []bool
+	// Allocation defaults to AllocGrow
+	Allocation Allocation
+}
+
+// workingPath is where data goes while downloading: the temp file with AllocTemp,
+// unless a finished file is already in place
+func workingPath(path string, mode Allocation) string {
+	if mode != AllocTemp {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		if _, err := os.Stat(path + PART_SUFFIX); os.IsNotExist(err) {
+			return path
+		}
+	}
+	return path + PART_SUFFIX
+}
+
+// allocate gives a freshly opened file its space according to mode
+func allocate(file *os.File, length int, mode Allocation) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= int64(length) {
+		return nil
+	}
+
+	switch mode {
+	case AllocSparse:
+		return file.Truncate(int64(length))
+	case AllocFull:
+		return preallocate(file, info.Size(), int64(length))
+	}
+	return nil
+}
+
+// dataFiles lists where the torrent's data is kept while downloading, one entry per file
+func dataFiles(path string, info torrent.InfoDict, opts Options) []string {
+	if len(info.Files) == 0 {
+		return []string{workingPath(path, opts.Allocation)}
+	}
+
+	root := filepath.Join(path, info.Name)
+	paths := make([]string, len(info.Files))
+	for i, f := range info.Files {
+		paths[i] = workingPath(filepath.Join(append([]string{root}, f.Path...)...), opts.Allocation)
+	}
+	return paths
+}
+
+// HasData reports whether anything of the torrent is on disk below path already, finished or still
+// being downloaded, in which case it is worth checking before downloading over it
+func HasData(path string, info torrent.InfoDict) bool {
+	paths := []string{path}
+	if len(info.Files) > 0 {
+		root := filepath.Join(path, info.Name)
+		paths = []string{root + PARTS_SUFFIX}
+		for _, f := range info.Files {
+			paths = append(paths, filepath.Join(append([]string{root}, f.Path...)...))
+		}
+	}
+
+	for _, p := range paths {
+		for _, candidate := range []string{p, p + PART_SUFFIX} {
+			if stat, err := os.Stat(candidate); err == nil && !stat.IsDir() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckSpace fails if the disk holding path can't take what is still missing of the wanted files.
+// Where free space can't be determined it doesn't complain
+func CheckSpace(path string, info torrent.InfoDict, opts Options) error {
+	var needed int64
+	if len(info.Files) == 0 {
+		needed = missing(workingPath(path, opts.Allocation), info.Length)
+	} else {
+		for i, filePath := range dataFiles(path, info, opts) {
+			if i < len(opts.Skip) && opts.Skip[i] {
+				continue
+			}
+			needed += missing(filePath, info.Files[i].Length)
+		}
+	}
+
+	// the nearest directory that already exists is on the disk we'll write to
+	dir := filepath.Dir(path)
+	if len(info.Files) > 0 {
+		dir = path
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	free, ok := freeSpace(dir)
+	if ok && free < needed {
+		return fmt.Errorf("not enough disk space in %s: %d bytes needed, %d available", dir, needed, free)
+	}
+	return nil
+}
+
+// missing is how many bytes a file at path still has to grow by to reach length.
+// Sparse files count as complete, which only makes the check more forgiving
+func missing(path string, length int) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return int64(length)
+	}
+	if info.Size() >= int64(length) {
+		return 0
+	}
+	return int64(length) - info.Size()
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves the blocks from size up to length with fallocate
+func preallocate(file *os.File, size int64, length int64) error {
+	for {
+		err := syscall.Fallocate(int(file.Fd()), 0, size, length-size)
+		if err != syscall.EINTR {
+			if err == syscall.EOPNOTSUPP {
+				// e.g. tmpfs on older kernels, a sparse file is the best we can do
+				return file.Truncate(length)
+			}
+			return err
+		}
+	}
+}
+
+// freeSpace returns the bytes available to us on the filesystem holding dir
+func freeSpace(dir string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
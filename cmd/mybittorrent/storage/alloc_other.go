@@ -0,0 +1,27 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// preallocate writes zeros from size up to length, as there is no portable fallocate
+func preallocate(file *os.File, size int64, length int64) error {
+	zeros := make([]byte, 1<<20)
+	for size < length {
+		n := int64(len(zeros))
+		if length-size < n {
+			n = length - size
+		}
+		written, err := file.WriteAt(zeros[:n], size)
+		if err != nil {
+			return err
+		}
+		size += int64(written)
+	}
+	return nil
+}
+
+// freeSpace is unknown on this platform
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+func TestHasData(t *testing.T) {
+	single := torrent.InfoDict{Name: "sample.bin", Length: 10, PieceLength: 10}
+	multi := torrent.InfoDict{Name: "sample", Length: 10, PieceLength: 10, Files: []torrent.FileEntry{
+		{Length: 4, Path: []string{"a"}},
+		{Length: 6, Path: []string{"dir", "b"}},
+	}}
+
+	tests := []struct {
+		name string
+		info torrent.InfoDict
+		// created below the download path before looking
+		files []string
+		want  bool
+	}{
+		{"fresh single file", single, nil, false},
+		{"single file", single, []string{""}, true},
+		{"single temp file", single, []string{PART_SUFFIX}, true},
+		// the download path of a multi file torrent is the directory the torrent goes in
+		{"fresh multi file", multi, nil, false},
+		{"torrent directory only", multi, []string{"sample/dir/"}, false},
+		{"one of the files", multi, []string{"sample/dir/b"}, true},
+		{"temp file", multi, []string{"sample/a" + PART_SUFFIX}, true},
+		{"parts file", multi, []string{"sample" + PARTS_SUFFIX}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := dir
+			if len(tt.info.Files) == 0 {
+				path = filepath.Join(dir, tt.info.Name)
+			}
+
+			for _, f := range tt.files {
+				name := path + f
+				if len(tt.info.Files) > 0 {
+					name = filepath.Join(path, f)
+				}
+				if f != "" && f[len(f)-1] == '/' {
+					if err := os.MkdirAll(name, 0755); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, []byte("x"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := HasData(path, tt.info); got != tt.want {
+				t.Fatalf("HasData is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
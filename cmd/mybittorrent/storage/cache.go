@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+// CACHE_SIZE is the default memory cap of a PieceCache
+const CACHE_SIZE = 64 << 20 // 64MiB
+
+// ErrHashMismatch is returned by PieceCache.WriteAt for the write completing a piece that fails verification.
+// The piece is dropped from the cache
+var ErrHashMismatch = errors.New("piece hash mismatch")
+
+// cacheEntry is one piece held in memory, possibly still being assembled
+type cacheEntry struct {
+	index int
+	// nil after an incomplete piece was spilled to disk, until its next block comes in
+	data []byte
+	// per block, nil once the piece is complete
+	received []bool
+	// blocks spilled to disk before the piece was complete
+	onDisk    []bool
+	remaining int
+	dirty     bool
+	elem      *list.Element
+}
+
+func (e *cacheEntry) complete() bool {
+	return e.received == nil
+}
+
+// PieceCache sits in front of another Storage, assembling blocks into pieces in memory.
+// Completed pieces are verified and written back in piece order once the cache is full or flushed,
+// and pieces read back, e.g. for seeding, stay around until they are the least recently used.
+// Blocks are expected to be BLOCK_LENGTH aligned, as they are on the wire
+type PieceCache struct {
+	backend  Storage
+	info     torrent.InfoDict
+	capacity int
+	// WriteThrough writes pieces back as soon as they are verified, for backends like a stream
+	// that should see them right away. Can be set before the first write
+	WriteThrough bool
+
+	mu      sync.Mutex
+	entries map[int]*cacheEntry
+	// front is the most recently used
+	lru  *list.List
+	used int
+}
+
+func NewPieceCache(backend Storage, info torrent.InfoDict, capacity int) *PieceCache {
+	return &PieceCache{
+		backend:  backend,
+		info:     info,
+		capacity: capacity,
+		entries:  make(map[int]*cacheEntry),
+		lru:      list.New(),
+	}
+}
+
+func (c *PieceCache) numBlocks(index int) int {
+	return (c.info.PieceSize(index) + protocol.BLOCK_LENGTH - 1) / protocol.BLOCK_LENGTH
+}
+
+// blockRange returns the blocks [first, end) fully covered by a write
+func (c *PieceCache) blockRange(index int, begin int, n int) (int, int) {
+	first := (begin + protocol.BLOCK_LENGTH - 1) / protocol.BLOCK_LENGTH
+	end := (begin + n) / protocol.BLOCK_LENGTH
+	if begin+n == c.info.PieceSize(index) {
+		// the last block of a piece is usually short
+		end = c.numBlocks(index)
+	}
+	return first, end
+}
+
+func (c *PieceCache) checkRange(index int, begin int, n int) error {
+	if index < 0 || index >= len(c.info.Pieces)/20 || begin < 0 || begin+n > c.info.PieceSize(index) {
+		return fmt.Errorf("range %d:%d+%d out of bounds", index, begin, n)
+	}
+	return nil
+}
+
+// touch marks an entry as the most recently used; caller holds c.mu
+func (c *PieceCache) touch(e *cacheEntry) {
+	if e.elem == nil {
+		e.elem = c.lru.PushFront(e)
+	} else {
+		c.lru.MoveToFront(e.elem)
+	}
+}
+
+// remove drops an entry; caller holds c.mu
+func (c *PieceCache) remove(e *cacheEntry) {
+	c.used -= len(e.data)
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.index)
+}
+
+func (c *PieceCache) WriteAt(index int, p []byte, begin int) (int, error) {
+	if err := c.checkRange(index, begin, len(p)); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[index]
+	if ok && e.complete() {
+		// a verified piece doesn't change, rewriting it is a no-op
+		c.touch(e)
+		return len(p), nil
+	}
+	if !ok {
+		numBlocks := c.numBlocks(index)
+		e = &cacheEntry{
+			index:     index,
+			received:  make([]bool, numBlocks),
+			onDisk:    make([]bool, numBlocks),
+			remaining: numBlocks,
+		}
+		c.entries[index] = e
+	}
+	if e.data == nil {
+		e.data = make([]byte, c.info.PieceSize(index))
+		c.used += len(e.data)
+	}
+	c.touch(e)
+
+	copy(e.data[begin:], p)
+	first, end := c.blockRange(index, begin, len(p))
+	for block := first; block < end; block++ {
+		if !e.received[block] {
+			e.received[block] = true
+			e.remaining--
+		}
+	}
+
+	if e.remaining == 0 {
+		if err := c.completePiece(e); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), c.shrink()
+}
+
+// completePiece verifies a piece whose last block just came in; caller holds c.mu
+func (c *PieceCache) completePiece(e *cacheEntry) error {
+	// bring back whatever was spilled to disk
+	for block, spilled := range e.onDisk {
+		if !spilled {
+			continue
+		}
+		begin := block * protocol.BLOCK_LENGTH
+		end := begin + protocol.BLOCK_LENGTH
+		if end > len(e.data) {
+			end = len(e.data)
+		}
+		if _, err := c.backend.ReadAt(e.index, e.data[begin:end], begin); err != nil {
+			c.remove(e)
+			return fmt.Errorf("reading back piece %d: %v", e.index, err)
+		}
+	}
+
+	hash := sha1.Sum(e.data)
+	if !bytes.Equal(hash[:], c.info.Pieces[e.index*20:e.index*20+20]) {
+		c.remove(e)
+		return ErrHashMismatch
+	}
+
+	e.received = nil
+	e.onDisk = nil
+	e.dirty = true
+
+	if c.WriteThrough {
+		if _, err := c.backend.WriteAt(e.index, e.data, 0); err != nil {
+			return fmt.Errorf("writing piece %d: %v", e.index, err)
+		}
+		e.dirty = false
+	}
+	return nil
+}
+
+func (c *PieceCache) ReadAt(index int, p []byte, begin int) (int, error) {
+	if err := c.checkRange(index, begin, len(p)); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[index]
+	if ok && e.complete() {
+		c.touch(e)
+		return copy(p, e.data[begin:]), nil
+	}
+	if ok {
+		// still being assembled, only the disk has anything to say about it
+		return c.backend.ReadAt(index, p, begin)
+	}
+
+	// keep the whole piece around, a peer asking for one block usually wants the rest too
+	data := make([]byte, c.info.PieceSize(index))
+	n, err := c.backend.ReadAt(index, data, 0)
+	if err != nil || n != len(data) {
+		return c.backend.ReadAt(index, p, begin)
+	}
+
+	e = &cacheEntry{index: index, data: data}
+	c.entries[index] = e
+	c.used += len(data)
+	c.touch(e)
+
+	n = copy(p, data[begin:])
+	return n, c.shrink()
+}
+
+// shrink gets the cache back under its capacity; caller holds c.mu.
+// Clean pieces are dropped first, then completed pieces are written back,
+// and as a last resort pieces still being assembled are spilled to disk
+func (c *PieceCache) shrink() error {
+	if c.used <= c.capacity {
+		return nil
+	}
+
+	c.evictClean()
+	if c.used <= c.capacity {
+		return nil
+	}
+
+	if err := c.writeBack(); err != nil {
+		return err
+	}
+	c.evictClean()
+
+	for elem := c.lru.Back(); elem != nil && c.used > c.capacity; {
+		e := elem.Value.(*cacheEntry)
+		elem = elem.Prev()
+		if e.complete() || e.data == nil {
+			continue
+		}
+		if err := c.spill(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictClean drops the least recently used pieces that are already on disk; caller holds c.mu
+func (c *PieceCache) evictClean() {
+	for elem := c.lru.Back(); elem != nil && c.used > c.capacity; {
+		e := elem.Value.(*cacheEntry)
+		elem = elem.Prev()
+		if e.complete() && !e.dirty {
+			c.remove(e)
+		}
+	}
+}
+
+// writeBack writes every completed piece to the backend, in piece order; caller holds c.mu
+func (c *PieceCache) writeBack() error {
+	var dirty []*cacheEntry
+	for _, e := range c.entries {
+		if e.complete() && e.dirty {
+			dirty = append(dirty, e)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].index < dirty[j].index })
+
+	for _, e := range dirty {
+		if _, err := c.backend.WriteAt(e.index, e.data, 0); err != nil {
+			return fmt.Errorf("writing piece %d: %v", e.index, err)
+		}
+		e.dirty = false
+	}
+	return nil
+}
+
+// spill writes the blocks received so far of an incomplete piece and frees its buffer; caller holds c.mu
+func (c *PieceCache) spill(e *cacheEntry) error {
+	for block, received := range e.received {
+		if !received || e.onDisk[block] {
+			continue
+		}
+		begin := block * protocol.BLOCK_LENGTH
+		end := begin + protocol.BLOCK_LENGTH
+		if end > len(e.data) {
+			end = len(e.data)
+		}
+		if _, err := c.backend.WriteAt(e.index, e.data[begin:end], begin); err != nil {
+			return fmt.Errorf("spilling piece %d: %v", e.index, err)
+		}
+		e.onDisk[block] = true
+	}
+
+	c.used -= len(e.data)
+	e.data = nil
+	return nil
+}
+
+// Flush writes back every completed piece, then flushes the backend.
+// Pieces still being assembled stay in memory
+func (c *PieceCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.writeBack(); err != nil {
+		return err
+	}
+	return c.backend.Flush()
+}
+
+func (c *PieceCache) Complete() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return c.backend.Complete()
+}
+
+func (c *PieceCache) Close() error {
+	err := c.Flush()
+	if closeErr := c.backend.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileStorage keeps a single file torrent in one file, pieces are written straight to their offset
+type FileStorage struct {
+	file        *os.File
+	path        string
+	pieceLength int
+	length      int
+}
+
+// NewFileStorage opens or creates the file at path for a torrent of the given total length.
+// Existing content is left alone, apart from anything past the end.
+func NewFileStorage(path string, pieceLength int, length int, mode Allocation) (*FileStorage, error) {
+	file, err := openFile(path, length, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{
+		file:        file,
+		path:        path,
+		pieceLength: pieceLength,
+		length:      length,
+	}, nil
+}
+
+// openFile opens or creates a file that should hold length bytes, cutting off anything past that.
+// With AllocTemp the file opened is the temp file next to path
+func openFile(path string, length int, mode Allocation) (*os.File, error) {
+	file, err := os.OpenFile(workingPath(path, mode), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// anything beyond the torrent's length can't be ours
+	info, err := file.Stat()
+	if err == nil && info.Size() > int64(length) {
+		err = file.Truncate(int64(length))
+	}
+	if err == nil {
+		err = allocate(file, length, mode)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// completeFile moves a finished temp file into place, files opened at their final path stay put
+func completeFile(file *os.File, path string) error {
+	if file.Name() == path {
+		return nil
+	}
+
+	err := file.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// offset translates a piece relative range into a file offset, checking it stays within the torrent
+func (s *FileStorage) offset(index int, begin int, n int) (int64, error) {
+	offset := index*s.pieceLength + begin
+	if index < 0 || begin < 0 || begin+n > s.pieceLength || offset+n > s.length {
+		return 0, fmt.Errorf("range %d:%d+%d out of bounds", index, begin, n)
+	}
+	return int64(offset), nil
+}
+
+func (s *FileStorage) ReadAt(index int, p []byte, begin int) (int, error) {
+	offset, err := s.offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.file.ReadAt(p, offset)
+}
+
+func (s *FileStorage) WriteAt(index int, p []byte, begin int) (int, error) {
+	offset, err := s.offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.file.WriteAt(p, offset)
+}
+
+func (s *FileStorage) Flush() error {
+	return s.file.Sync()
+}
+
+func (s *FileStorage) Complete() error {
+	return completeFile(s.file, s.path)
+}
+
+func (s *FileStorage) Close() error {
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+// PARTS_SUFFIX is appended to a multi file torrent's directory to get the file keeping the parts of skipped
+// files that share a piece with a wanted one, so that piece can still be verified and served
+const PARTS_SUFFIX = ".parts"
+
+// fileSpan is a file of a multi file torrent, or a part of one, placed at its offset in the torrent's byte stream
+type fileSpan struct {
+	path   string
+	offset int
+	length int
+	// where the span starts within file, only the parts file holds more than one span
+	base int64
+	// nil for the parts of skipped files that aren't kept
+	file *os.File
+}
+
+// MultiFileStorage lays the torrent out as one stream running across all of its files,
+// so a piece may be split over several of them
+type MultiFileStorage struct {
+	files       []*fileSpan
+	pieceLength int
+	length      int
+	// nil unless a skipped file shares a piece with a wanted one
+	parts *os.File
+}
+
+// SanitizePath joins a path from the torrent onto dir, rejecting anything that could escape it
+func SanitizePath(dir string, components []string) (string, error) {
+	if len(components) == 0 {
+		return "", fmt.Errorf("empty path")
+	}
+
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, "/\\\x00") || filepath.IsAbs(c) || filepath.VolumeName(c) != "" {
+			return "", fmt.Errorf("invalid path component %q", c)
+		}
+	}
+
+	return filepath.Join(dir, filepath.Join(components...)), nil
+}
+
+// NewMultiFileStorage creates the torrent's files below dir/<name>, along with their directories.
+// As with NewFileStorage existing content is left alone.
+// Files marked in opts.Skip are never created. The bytes they have in pieces shared with a wanted file
+// go into the parts file instead; writes to the rest are dropped and reads fail
+func NewMultiFileStorage(dir string, info torrent.InfoDict, opts Options) (*MultiFileStorage, error) {
+	root, err := SanitizePath(dir, []string{info.Name})
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent name: %v", err)
+	}
+
+	s := &MultiFileStorage{
+		pieceLength: info.PieceLength,
+	}
+	// the spans kept in the parts file, and how long it is
+	var partSpans []*fileSpan
+	partsLength := 0
+
+	for i, f := range info.Files {
+		path, err := SanitizePath(root, f.Path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		if skipped(opts.Skip, i) {
+			partSpans = append(partSpans, s.skippedSpans(info, opts.Skip, i, path, &partsLength)...)
+			s.length += f.Length
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		file, err := openFile(path, f.Length, opts.Allocation)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.files = append(s.files, &fileSpan{path: path, offset: s.length, length: f.Length, file: file})
+		s.length += f.Length
+	}
+
+	if partsLength > 0 {
+		parts, err := openFile(root+PARTS_SUFFIX, partsLength, AllocGrow)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.parts = parts
+		for _, f := range partSpans {
+			f.file = parts
+		}
+	}
+
+	return s, nil
+}
+
+func skipped(skip []bool, index int) bool {
+	return index < len(skip) && skip[index]
+}
+
+// sharedPiece reports whether a piece overlaps any wanted file
+func sharedPiece(info torrent.InfoDict, skip []bool, piece int) bool {
+	for i := range info.Files {
+		if skipped(skip, i) {
+			continue
+		}
+		first, end := info.FilePieces(i)
+		if first <= piece && piece < end {
+			return true
+		}
+	}
+	return false
+}
+
+// skippedSpans lays out a skipped file starting at s.length. Only its first and last piece can be shared
+// with a wanted file, the bytes it has in those are given room in the parts file after *partsLength.
+// Returns the spans that belong in the parts file
+func (s *MultiFileStorage) skippedSpans(info torrent.InfoDict, skip []bool, index int, path string, partsLength *int) []*fileSpan {
+	offset, end := s.length, s.length+info.Files[index].Length
+	firstPiece, endPiece := info.FilePieces(index)
+
+	// the parts of the file to keep, as ranges of the torrent's stream
+	var keep [][2]int
+	if firstPiece < endPiece && sharedPiece(info, skip, firstPiece) {
+		keep = append(keep, [2]int{offset, min(end, (firstPiece+1)*info.PieceLength)})
+	}
+	if lastPiece := endPiece - 1; lastPiece > firstPiece && sharedPiece(info, skip, lastPiece) {
+		keep = append(keep, [2]int{lastPiece * info.PieceLength, end})
+	}
+
+	var parts []*fileSpan
+	for _, r := range keep {
+		if r[0] > offset {
+			s.files = append(s.files, &fileSpan{path: path, offset: offset, length: r[0] - offset})
+		}
+		part := &fileSpan{path: path, offset: r[0], length: r[1] - r[0], base: int64(*partsLength)}
+		s.files = append(s.files, part)
+		parts = append(parts, part)
+		*partsLength += part.length
+		offset = r[1]
+	}
+	if offset < end {
+		s.files = append(s.files, &fileSpan{path: path, offset: offset, length: end - offset})
+	}
+	return parts
+}
+
+// offset translates a piece relative range into an offset in the torrent's stream
+func (s *MultiFileStorage) offset(index int, begin int, n int) (int, error) {
+	offset := index*s.pieceLength + begin
+	if index < 0 || begin < 0 || begin+n > s.pieceLength || offset+n > s.length {
+		return 0, fmt.Errorf("range %d:%d+%d out of bounds", index, begin, n)
+	}
+	return offset, nil
+}
+
+// span calls fn for every file overlapping the range, with the part of p that belongs to it.
+// Zero length files never overlap anything
+func (s *MultiFileStorage) span(offset int, p []byte, fn func(f *fileSpan, part []byte, fileOffset int64) (int, error)) (int, error) {
+	total := 0
+	for _, f := range s.files {
+		if len(p) == 0 {
+			break
+		}
+		if offset >= f.offset+f.length || f.length == 0 {
+			continue
+		}
+
+		fileOffset := offset - f.offset
+		n := f.length - fileOffset
+		if n > len(p) {
+			n = len(p)
+		}
+
+		written, err := fn(f, p[:n], f.base+int64(fileOffset))
+		total += written
+		if err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		offset += n
+	}
+	return total, nil
+}
+
+func (s *MultiFileStorage) ReadAt(index int, p []byte, begin int) (int, error) {
+	offset, err := s.offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.span(offset, p, func(f *fileSpan, part []byte, fileOffset int64) (int, error) {
+		if f.file == nil {
+			return 0, fmt.Errorf("%s is skipped", f.path)
+		}
+		return f.file.ReadAt(part, fileOffset)
+	})
+}
+
+func (s *MultiFileStorage) WriteAt(index int, p []byte, begin int) (int, error) {
+	offset, err := s.offset(index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.span(offset, p, func(f *fileSpan, part []byte, fileOffset int64) (int, error) {
+		if f.file == nil {
+			// the part of a boundary piece belonging to a skipped file
+			return len(part), nil
+		}
+		return f.file.WriteAt(part, fileOffset)
+	})
+}
+
+// wanted returns the spans of wanted files, which have a file of their own
+func (s *MultiFileStorage) wanted() []*fileSpan {
+	var files []*fileSpan
+	for _, f := range s.files {
+		if f.file != nil && f.file != s.parts {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (s *MultiFileStorage) Flush() error {
+	for _, f := range s.wanted() {
+		if err := f.file.Sync(); err != nil {
+			return fmt.Errorf("%s: %v", f.path, err)
+		}
+	}
+	if s.parts != nil {
+		return s.parts.Sync()
+	}
+	return nil
+}
+
+// Complete moves temp files into place. The parts file stays, should a skipped file be wanted later
+func (s *MultiFileStorage) Complete() error {
+	for _, f := range s.wanted() {
+		if err := completeFile(f.file, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MultiFileStorage) Close() error {
+	files := s.wanted()
+	if s.parts != nil {
+		files = append(files, &fileSpan{path: s.parts.Name(), file: s.parts})
+	}
+
+	var err error
+	for _, f := range files {
+		if syncErr := f.file.Sync(); err == nil && syncErr != nil {
+			err = syncErr
+		}
+		if closeErr := f.file.Close(); err == nil && closeErr != nil {
+			err = closeErr
+		}
+	}
+	s.files = nil
+	s.parts = nil
+	return err
+}
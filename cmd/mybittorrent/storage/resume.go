@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// RESUME_SUFFIX is appended to the output path to get the sidecar resume file
+const RESUME_SUFFIX = ".resume"
+
+// RESUME_VERSION is bumped whenever the resume file format changes, older files are ignored
+const RESUME_VERSION = 1
+
+func ResumePath(path string) string {
+	return path + RESUME_SUFFIX
+}
+
+// ResumeData is what a download carries over to the next run
+type ResumeData struct {
+	Verified protocol.Bitfield
+	// peers worth trying again first
+	Peers      []string
+	Downloaded int64
+	Uploaded   int64
+}
+
+// fileStat is what the resume file remembers of each data file, to notice changes made behind our back
+type fileStat struct {
+	size    int64
+	modTime int64
+}
+
+// Resume keeps the fast-resume file of one download.
+// Besides the verified pieces it records the info hash and the size and mtime of every data file,
+// so a resume file from another torrent or for files modified since is rejected and a recheck happens
+type Resume struct {
+	path  string
+	info  torrent.InfoDict
+	files []string
+}
+
+// NewResume sets up the resume file for a download to path, opts must be the ones the storage is opened with
+func NewResume(path string, info torrent.InfoDict, opts Options) *Resume {
+	return &Resume{
+		path:  path,
+		info:  info,
+		files: dataFiles(path, info, opts),
+	}
+}
+
+// stat records the current state of the data files, missing files get a size of -1
+func (r *Resume) stat() []fileStat {
+	stats := make([]fileStat, len(r.files))
+	for i, path := range r.files {
+		info, err := os.Stat(path)
+		if err != nil {
+			stats[i] = fileStat{size: -1}
+			continue
+		}
+		stats[i] = fileStat{size: info.Size(), modTime: info.ModTime().UnixNano()}
+	}
+	return stats
+}
+
+// Load reads the resume file, failing if it doesn't exist, is damaged, or no longer matches the data on disk.
+// Must be called before the storage is opened, as opening may touch the files
+func (r *Resume) Load() (ResumeData, error) {
+	content, err := os.ReadFile(ResumePath(r.path))
+	if err != nil {
+		return ResumeData{}, err
+	}
+
+	decoded, rest, err := bencode.DecodeBencode(content)
+	if err != nil || len(rest) != 0 {
+		return ResumeData{}, fmt.Errorf("damaged resume file")
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return ResumeData{}, fmt.Errorf("damaged resume file")
+	}
+
+	if version, _ := dict["version"].(int); version != RESUME_VERSION {
+		return ResumeData{}, fmt.Errorf("unsupported resume file version %d", version)
+	}
+	if !bytes.Equal(bencode.Bytes(dict["info hash"]), r.info.Hash()) {
+		return ResumeData{}, fmt.Errorf("resume file belongs to another torrent")
+	}
+
+	// any file changed since the last save may hold pieces we haven't verified
+	files, _ := dict["files"].([]interface{})
+	stats := r.stat()
+	if len(files) != len(stats) {
+		return ResumeData{}, fmt.Errorf("resume file lists %d files, expected %d", len(files), len(stats))
+	}
+	for i, f := range files {
+		fileDict, _ := f.(map[string]interface{})
+		size, _ := fileDict["size"].(int)
+		modTime, _ := fileDict["mtime"].(int)
+		if int64(size) != stats[i].size || int64(modTime) != stats[i].modTime {
+			return ResumeData{}, fmt.Errorf("%s changed since the resume file was written", r.files[i])
+		}
+	}
+
+	verified, err := protocol.UnmarshalBitfield(bencode.Bytes(dict["pieces"]), len(r.info.Pieces)/20)
+	if err != nil {
+		return ResumeData{}, err
+	}
+
+	data := ResumeData{Verified: verified}
+	peers, _ := dict["peers"].([]interface{})
+	for _, p := range peers {
+		if addr, ok := p.(string); ok {
+			data.Peers = append(data.Peers, addr)
+		}
+	}
+	downloaded, _ := dict["downloaded"].(int)
+	uploaded, _ := dict["uploaded"].(int)
+	data.Downloaded = int64(downloaded)
+	data.Uploaded = int64(uploaded)
+
+	return data, nil
+}
+
+// Save writes the resume file. The data must have been flushed before,
+// so the resume file never claims a piece that isn't on disk, and the mtimes recorded are final
+func (r *Resume) Save(data ResumeData) error {
+	files := make([]interface{}, 0, len(r.files))
+	for _, stat := range r.stat() {
+		files = append(files, map[string]interface{}{
+			"size":  stat.size,
+			"mtime": stat.modTime,
+		})
+	}
+
+	peers := data.Peers
+	if peers == nil {
+		peers = []string{}
+	}
+
+	content, err := bencode.Encode(map[string]interface{}{
+		"version":    RESUME_VERSION,
+		"info hash":  r.info.Hash(),
+		"pieces":     data.Verified.Marshal(),
+		"files":      files,
+		"peers":      peers,
+		"downloaded": data.Downloaded,
+		"uploaded":   data.Uploaded,
+	})
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(ResumePath(r.path), content)
+}
+
+// Remove deletes the resume file once the download is complete
+func (r *Resume) Remove() error {
+	err := os.Remove(ResumePath(r.path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Recheck hashes every piece already in storage, returning the ones that are intact.
+// Used when there is data on disk but no usable resume file.
+func Recheck(store Storage, info torrent.InfoDict) protocol.Bitfield {
+	numPieces := len(info.Pieces) / 20
+	verified := protocol.NewBitfield(numPieces)
+
+	for i := 0; i < numPieces; i++ {
+		data := make([]byte, info.PieceSize(i))
+		n, err := store.ReadAt(i, data, 0)
+		if err != nil || n != len(data) {
+			// past the end of a short file
+			util.DebugLog("recheck could not read piece ", i, err)
+			continue
+		}
+
+		if util.GenerateSHA1Checksum(data) == hex.EncodeToString(info.Pieces[i*20:i*20+20]) {
+			verified.Set(i)
+		}
+	}
+
+	return verified
+}
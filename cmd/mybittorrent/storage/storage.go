@@ -0,0 +1,27 @@
+package storage
+
+import "github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+
+// Storage holds the torrent's data on behalf of the downloader.
+// Offsets are relative to the start of a piece.
+type Storage interface {
+	ReadAt(index int, p []byte, begin int) (int, error)
+	WriteAt(index int, p []byte, begin int) (int, error)
+	// Flush makes sure everything written so far is on disk
+	Flush() error
+	// Complete is called once every wanted piece is verified, e.g. to move temp files into place
+	Complete() error
+	Close() error
+}
+
+// Open picks the storage for a torrent: a single file at path,
+// or for multi file torrents a directory named after the torrent inside path
+func Open(path string, info torrent.InfoDict, opts Options) (Storage, error) {
+	if opts.Allocation == "" {
+		opts.Allocation = AllocGrow
+	}
+	if len(info.Files) > 0 {
+		return NewMultiFileStorage(path, info, opts)
+	}
+	return NewFileStorage(path, info.PieceLength, info.Length, opts.Allocation)
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+// STREAM_WINDOW is how many pieces a stream may have to hold back while waiting for an earlier one
+const STREAM_WINDOW = 8
+
+// StreamStorage writes verified pieces to a writer in order, e.g. stdout.
+// Pieces arriving ahead of the next one are held until it turns up, so pair it with a
+// picker that stays within a window, like worker.NewStreamingPicker
+type StreamStorage struct {
+	w    io.Writer
+	info torrent.InfoDict
+
+	mu sync.Mutex
+	// next piece to write out
+	next    int
+	pending map[int][]byte
+}
+
+func NewStreamStorage(w io.Writer, info torrent.InfoDict) *StreamStorage {
+	return &StreamStorage{
+		w:       w,
+		info:    info,
+		pending: make(map[int][]byte),
+	}
+}
+
+// WriteAt only takes whole pieces, blocks can't be streamed before their piece is verified
+func (s *StreamStorage) WriteAt(index int, p []byte, begin int) (int, error) {
+	if index < 0 || index >= len(s.info.Pieces)/20 || begin != 0 || len(p) != s.info.PieceSize(index) {
+		return 0, fmt.Errorf("stream only takes whole pieces, got %d:%d+%d", index, begin, len(p))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < s.next {
+		return len(p), nil
+	}
+	if _, ok := s.pending[index]; !ok {
+		s.pending[index] = append([]byte(nil), p...)
+	}
+
+	for {
+		data, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		if _, err := s.w.Write(data); err != nil {
+			// e.g. the reading end of the pipe went away
+			return 0, err
+		}
+		delete(s.pending, s.next)
+		s.next++
+	}
+
+	return len(p), nil
+}
+
+// ReadAt can only serve pieces still held back, anything written out is gone
+func (s *StreamStorage) ReadAt(index int, p []byte, begin int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.pending[index]
+	if !ok || begin < 0 || begin+len(p) > len(data) {
+		return 0, fmt.Errorf("piece %d is not available from the stream", index)
+	}
+	return copy(p, data[begin:]), nil
+}
+
+func (s *StreamStorage) Flush() error {
+	return nil
+}
+
+func (s *StreamStorage) Complete() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next != len(s.info.Pieces)/20 {
+		return fmt.Errorf("stream stopped at piece %d", s.next)
+	}
+	return nil
+}
+
+func (s *StreamStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,27 @@
+package torrent
+
+import "strings"
+
+// FileOffset returns where a file of a multi file torrent starts in the torrent's byte stream
+func (info InfoDict) FileOffset(index int) int {
+	offset := 0
+	for _, f := range info.Files[:index] {
+		offset += f.Length
+	}
+	return offset
+}
+
+// FilePieces returns the range of pieces [first, end) overlapping a file, empty for zero length files
+func (info InfoDict) FilePieces(index int) (int, int) {
+	offset := info.FileOffset(index)
+	length := info.Files[index].Length
+	if length == 0 {
+		return 0, 0
+	}
+	return offset / info.PieceLength, (offset + length + info.PieceLength - 1) / info.PieceLength
+}
+
+// DisplayPath is the file's path within the torrent, always separated by slashes
+func (f FileEntry) DisplayPath() string {
+	return strings.Join(f.Path, "/")
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// InfoFromMap converts a decoded info dictionary, from a .torrent file or fetched from peers
+func InfoFromMap(infoMap map[string]interface{}) (InfoDict, error) {
+	var infoDict InfoDict
+	if length, ok := infoMap["length"].(int); ok {
+		infoDict.Length = length
+	}
+	infoDict.Name = bencode.String(infoMap["name"])
+	if pieceLength, ok := infoMap["piece length"].(int); ok {
+		infoDict.PieceLength = pieceLength
+	}
+	// pieces are non-UTF-8 bytes, unless by chance they happen to be valid UTF-8
+	infoDict.Pieces = []byte(bencode.String(infoMap["pieces"]))
+	if files, ok := infoMap["files"].([]interface{}); ok {
+		var err error
+		infoDict.Files, err = decodeFiles(files)
+		if err != nil {
+			return InfoDict{}, err
+		}
+		// pieces run across all files as if they were one
+		infoDict.Length = 0
+		for _, f := range infoDict.Files {
+			infoDict.Length += f.Length
+		}
+	}
+
+	if infoDict.PieceLength <= 0 || len(infoDict.Pieces) == 0 || len(infoDict.Pieces)%20 != 0 {
+		return InfoDict{}, fmt.Errorf("invalid piece length or hashes")
+	}
+	return infoDict, nil
+}
+
+// decodeFiles converts the files list of a multi file torrent
+func decodeFiles(files []interface{}) ([]FileEntry, error) {
+	entries := make([]FileEntry, 0, len(files))
+	for i, f := range files {
+		fileMap, ok := f.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file %d is not a dictionary", i)
+		}
+
+		length, ok := fileMap["length"].(int)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("file %d has an invalid length", i)
+		}
+
+		pathList, ok := fileMap["path"].([]interface{})
+		if !ok || len(pathList) == 0 {
+			return nil, fmt.Errorf("file %d has no path", i)
+		}
+		path := make([]string, 0, len(pathList))
+		for _, component := range pathList {
+			// non UTF-8 names come back as bytes
+			switch component.(type) {
+			case string, []byte:
+				path = append(path, bencode.String(component))
+			default:
+				return nil, fmt.Errorf("file %d has an invalid path", i)
+			}
+		}
+
+		entries = append(entries, FileEntry{Length: length, Path: path})
+	}
+	return entries, nil
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"crypto/sha1"
 	"fmt"
+	"strings"
 )
 
 type TorrentMetadata struct {
@@ -11,20 +12,64 @@ type TorrentMetadata struct {
 }
 
 type InfoDict struct {
+	// Length is the total of all files for multi file torrents
 	Length      int    `json:"length"`
 	Name        string `json:"name"`
 	PieceLength int    `json:"piece length"`
 	Pieces      []byte `json:"pieces"`
+	// Files is only set for multi file torrents, Name is then the directory they go in
+	Files []FileEntry `json:"files"`
+	// Raw is the bencoded dictionary as read from the .torrent file or received from peers,
+	// which may hold keys we don't model
+	Raw []byte `json:"-"`
+}
+
+// FileEntry is one file of a multi file torrent, its path is relative to the torrent's directory
+type FileEntry struct {
+	Length int      `json:"length"`
+	Path   []string `json:"path"`
 }
 
 func (info InfoDict) Hash() []byte {
+	if info.Raw != nil {
+		hash := sha1.Sum(info.Raw)
+		return hash[:]
+	}
+
 	encodeInfoDict := EncodeInfoDict(info)
 	h := sha1.New()
 	h.Write([]byte(encodeInfoDict))
 	return h.Sum(nil)
 }
 
+// PieceSize returns the length of a piece, the last one is usually shorter
+func (info InfoDict) PieceSize(index int) int {
+	begin := index * info.PieceLength
+	end := begin + info.PieceLength
+	if end > info.Length {
+		end = info.Length
+	}
+	return end - begin
+}
+
 func EncodeInfoDict(info InfoDict) string {
+	if info.Raw != nil {
+		return string(info.Raw)
+	}
+	if len(info.Files) > 0 {
+		// keys in sorted order, multi file torrents have no top level length
+		var files strings.Builder
+		for _, f := range info.Files {
+			files.WriteString(fmt.Sprintf("d6:lengthi%de4:pathl", f.Length))
+			for _, component := range f.Path {
+				files.WriteString(fmt.Sprintf("%d:%s", len(component), component))
+			}
+			files.WriteString("ee")
+		}
+		return fmt.Sprintf("d5:filesl%se4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
+			files.String(), len(info.Name), info.Name, info.PieceLength, len(info.Pieces), info.Pieces)
+	}
+
 	return fmt.Sprintf("d6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
 		info.Length, len(info.Name), info.Name, info.PieceLength, len(info.Pieces), info.Pieces)
 }
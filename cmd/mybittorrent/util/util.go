@@ -7,6 +7,9 @@ import (
 	"os"
 )
 
+// Logger carries status messages. They go to stdout, unless that is taken by data, e.g. a download streamed to stdout
+var Logger = log.New(os.Stdout, "", 0)
+
 // Debug logger function
 func DebugLog(title string, message ...interface{}) {
 	if os.Getenv("DEBUG") == "true" {
@@ -14,6 +17,17 @@ func DebugLog(title string, message ...interface{}) {
 	}
 }
 
+// WriteFileAtomic writes to a temp file next to path first and renames it into place,
+// so an interruption leaves the previous content intact
+func WriteFileAtomic(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
 func GenerateSHA1Checksum(data []byte) string {
 	h := sha1.New()
 	h.Write(data)
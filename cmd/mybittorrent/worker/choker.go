@@ -0,0 +1,230 @@
+package worker
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+)
+
+const (
+	// UPLOAD_SLOTS is how many peers are unchoked for their rates, the optimistic unchoke comes on top
+	UPLOAD_SLOTS = 4
+	// CHOKE_INTERVAL is how often the peers to unchoke are picked again by rate
+	CHOKE_INTERVAL = 10 * time.Second
+	// OPTIMISTIC_INTERVAL is how often the optimistic unchoke moves on to another peer
+	OPTIMISTIC_INTERVAL = 30 * time.Second
+	// peers connected for less than NEW_PEER_AGE are NEW_PEER_WEIGHT times as likely to be
+	// unchoked optimistically, they have nothing to offer yet and need a start
+	NEW_PEER_AGE    = time.Minute
+	NEW_PEER_WEIGHT = 3
+)
+
+// ChokeCandidate is a peer as the choker sees it
+type ChokeCandidate struct {
+	Peer *protocol.Peer
+	// Interested is set if the peer wants something from us, nobody else is unchoked
+	Interested bool
+	// Downloaded and Uploaded are the byte totals with the peer so far
+	Downloaded int64
+	Uploaded   int64
+}
+
+// Choker decides who we upload to, tit-for-tat: every CHOKE_INTERVAL the Slots interested peers
+// sending us the most are unchoked, or those we send the most to once we are seeding.
+// One more peer is unchoked optimistically, rotated every OPTIMISTIC_INTERVAL, so newcomers get a chance
+// to show what they can do and we may find better partners.
+// Time is passed in rather than read, and it is not safe for concurrent use
+type Choker struct {
+	Slots int
+
+	rng            *rand.Rand
+	seeding        bool
+	lastRechoke    time.Time
+	lastOptimistic time.Time
+	regular        map[*protocol.Peer]bool
+	optimistic     *protocol.Peer
+	// when each peer was first seen, and its byte count and rate as of the last rechoke
+	joined map[*protocol.Peer]time.Time
+	counts map[*protocol.Peer]int64
+	rates  map[*protocol.Peer]float64
+}
+
+// NewChoker with rng nil seeds its own
+func NewChoker(slots int, rng *rand.Rand) *Choker {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(rand.Int63()))
+	}
+
+	return &Choker{
+		Slots:   slots,
+		rng:     rng,
+		regular: make(map[*protocol.Peer]bool),
+		joined:  make(map[*protocol.Peer]time.Time),
+		counts:  make(map[*protocol.Peer]int64),
+		rates:   make(map[*protocol.Peer]float64),
+	}
+}
+
+// Update takes the peers connected now and returns the ones to unchoke, all others get choked.
+// Peers are only ranked again once CHOKE_INTERVAL passed; in between, slots freed by peers
+// leaving or losing interest are filled right away, so calling it often is fine
+func (c *Choker) Update(peers []ChokeCandidate, seeding bool, now time.Time) map[*protocol.Peer]bool {
+	c.forget(peers, now)
+
+	rechoke := now.Sub(c.lastRechoke) >= CHOKE_INTERVAL
+	if rechoke {
+		c.measure(peers, seeding, now)
+		c.lastRechoke = now
+	}
+
+	var interested []*protocol.Peer
+	for _, candidate := range peers {
+		if candidate.Interested {
+			interested = append(interested, candidate.Peer)
+		}
+	}
+	c.rank(interested)
+
+	regular := make(map[*protocol.Peer]bool)
+	if !rechoke {
+		// between rechokes the peers unchoked stay so, as long as they are interested
+		for _, p := range interested {
+			if c.regular[p] {
+				regular[p] = true
+			}
+		}
+	}
+	for _, p := range interested {
+		if len(regular) >= c.Slots {
+			break
+		}
+		regular[p] = true
+	}
+	c.regular = regular
+
+	c.updateOptimistic(interested, now)
+
+	unchoked := make(map[*protocol.Peer]bool, len(c.regular)+1)
+	for p := range c.regular {
+		unchoked[p] = true
+	}
+	if c.optimistic != nil {
+		unchoked[c.optimistic] = true
+	}
+	return unchoked
+}
+
+// forget drops the peers that went away and notes the ones that just came
+func (c *Choker) forget(peers []ChokeCandidate, now time.Time) {
+	present := make(map[*protocol.Peer]bool, len(peers))
+	for _, candidate := range peers {
+		present[candidate.Peer] = true
+		if _, ok := c.joined[candidate.Peer]; !ok {
+			c.joined[candidate.Peer] = now
+		}
+	}
+
+	for p := range c.joined {
+		if !present[p] {
+			delete(c.joined, p)
+			delete(c.counts, p)
+			delete(c.rates, p)
+			delete(c.regular, p)
+		}
+	}
+	if c.optimistic != nil && !present[c.optimistic] {
+		c.optimistic = nil
+	}
+}
+
+// measure turns the byte totals into rates over the time since the last rechoke
+func (c *Choker) measure(peers []ChokeCandidate, seeding bool, now time.Time) {
+	elapsed := now.Sub(c.lastRechoke).Seconds()
+	if c.lastRechoke.IsZero() || elapsed <= 0 {
+		elapsed = CHOKE_INTERVAL.Seconds()
+	}
+
+	// the download just finished, what counts now is what we sent
+	if seeding != c.seeding {
+		c.seeding = seeding
+		c.counts = make(map[*protocol.Peer]int64)
+	}
+
+	for _, candidate := range peers {
+		count := candidate.Downloaded
+		if seeding {
+			count = candidate.Uploaded
+		}
+		delta := count - c.counts[candidate.Peer]
+		c.rates[candidate.Peer] = float64(delta) / elapsed
+		c.counts[candidate.Peer] = count
+	}
+}
+
+// rank sorts peers fastest first. Ties go to peers unchoked already, so nobody is choked for nothing,
+// then to the ones connected longest
+func (c *Choker) rank(peers []*protocol.Peer) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		if c.rates[a] != c.rates[b] {
+			return c.rates[a] > c.rates[b]
+		}
+		if c.regular[a] != c.regular[b] {
+			return c.regular[a]
+		}
+		return c.joined[a].Before(c.joined[b])
+	})
+}
+
+// updateOptimistic moves the optimistic unchoke on once OPTIMISTIC_INTERVAL passed,
+// or right away if its peer lost interest or earned a regular slot
+func (c *Choker) updateOptimistic(interested []*protocol.Peer, now time.Time) {
+	stillInterested := false
+	for _, p := range interested {
+		if p == c.optimistic {
+			stillInterested = true
+		}
+	}
+
+	due := now.Sub(c.lastOptimistic) >= OPTIMISTIC_INTERVAL
+	if c.optimistic != nil && stillInterested && !c.regular[c.optimistic] && !due {
+		return
+	}
+
+	// everyone choked and interested may be picked, newcomers more likely
+	var choices []*protocol.Peer
+	weights := 0
+	for _, p := range interested {
+		if c.regular[p] || (p == c.optimistic && due) {
+			continue
+		}
+		choices = append(choices, p)
+		weights += c.weight(p, now)
+	}
+	if len(choices) == 0 {
+		// nobody else to rotate to, the current one keeps its slot if it can
+		if c.optimistic != nil && (!stillInterested || c.regular[c.optimistic]) {
+			c.optimistic = nil
+		}
+		return
+	}
+
+	pick := c.rng.Intn(weights)
+	for _, p := range choices {
+		pick -= c.weight(p, now)
+		if pick < 0 {
+			c.optimistic = p
+			break
+		}
+	}
+	c.lastOptimistic = now
+}
+
+func (c *Choker) weight(p *protocol.Peer, now time.Time) int {
+	if now.Sub(c.joined[p]) < NEW_PEER_AGE {
+		return NEW_PEER_WEIGHT
+	}
+	return 1
+}
@@ -0,0 +1,206 @@
+package worker
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+)
+
+// epoch is the fake clock's first reading, long after the zero time the choker starts from
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newPeers makes n peers to hand to the choker
+func newPeers(n int) []*protocol.Peer {
+	peers := make([]*protocol.Peer, n)
+	for i := range peers {
+		peers[i] = &protocol.Peer{Addr: fmt.Sprintf("10.0.0.%d:6881", i+1)}
+	}
+	return peers
+}
+
+// candidatesOf makes every peer an interested candidate with the given byte totals
+func candidatesOf(peers []*protocol.Peer, downloaded []int64, uploaded []int64) []ChokeCandidate {
+	candidates := make([]ChokeCandidate, len(peers))
+	for i, p := range peers {
+		candidates[i] = ChokeCandidate{Peer: p, Interested: true}
+		if downloaded != nil {
+			candidates[i].Downloaded = downloaded[i]
+		}
+		if uploaded != nil {
+			candidates[i].Uploaded = uploaded[i]
+		}
+	}
+	return candidates
+}
+
+func TestChokerRanking(t *testing.T) {
+	tests := []struct {
+		name       string
+		slots      int
+		downloaded []int64
+		uploaded   []int64
+		// peers not interested in us
+		notInterested []int
+		seeding       bool
+		// peers that must get a regular slot, and how many are unchoked with the optimistic one
+		want     []int
+		unchoked int
+	}{
+		{
+			name:       "fastest uploaders to us",
+			slots:      2,
+			downloaded: []int64{100, 500, 300, 0, 0},
+			uploaded:   []int64{900, 0, 0, 800, 700},
+			want:       []int{1, 2},
+			unchoked:   3,
+		},
+		{
+			name:       "fastest downloaders from us when seeding",
+			slots:      2,
+			downloaded: []int64{100, 500, 300, 0, 0},
+			uploaded:   []int64{900, 0, 0, 800, 700},
+			seeding:    true,
+			want:       []int{0, 3},
+			unchoked:   3,
+		},
+		{
+			name:          "peers not interested stay choked",
+			slots:         2,
+			downloaded:    []int64{100, 500, 300},
+			notInterested: []int{1},
+			want:          []int{2, 0},
+			unchoked:      2,
+		},
+		{
+			name:       "fewer peers than slots",
+			slots:      4,
+			downloaded: []int64{100, 0},
+			want:       []int{0, 1},
+			unchoked:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers := newPeers(len(tt.downloaded))
+			candidates := candidatesOf(peers, tt.downloaded, tt.uploaded)
+			for _, i := range tt.notInterested {
+				candidates[i].Interested = false
+			}
+
+			c := NewChoker(tt.slots, rand.New(rand.NewSource(1)))
+			unchoked := c.Update(candidates, tt.seeding, epoch)
+
+			if len(c.regular) != len(tt.want) {
+				t.Fatalf("%d regular slots taken, want %d", len(c.regular), len(tt.want))
+			}
+			for _, i := range tt.want {
+				if !c.regular[peers[i]] || !unchoked[peers[i]] {
+					t.Fatalf("peer %d didn't get a regular slot", i)
+				}
+			}
+			for _, i := range tt.notInterested {
+				if unchoked[peers[i]] {
+					t.Fatalf("peer %d unchoked without being interested", i)
+				}
+			}
+			if len(unchoked) != tt.unchoked {
+				t.Fatalf("%d peers unchoked, want %d", len(unchoked), tt.unchoked)
+			}
+		})
+	}
+}
+
+func TestChokerRechoke(t *testing.T) {
+	peers := newPeers(3)
+	c := NewChoker(1, rand.New(rand.NewSource(1)))
+
+	c.Update(candidatesOf(peers, []int64{1000, 500, 0}, nil), false, epoch)
+	if !c.regular[peers[0]] {
+		t.Fatal("fastest peer not unchoked")
+	}
+
+	// peer 1 overtakes, but rates are only compared again after CHOKE_INTERVAL
+	c.Update(candidatesOf(peers, []int64{1000, 5000, 0}, nil), false, epoch.Add(CHOKE_INTERVAL/2))
+	if !c.regular[peers[0]] {
+		t.Fatal("rechoked before CHOKE_INTERVAL")
+	}
+
+	// what counts is the rate since the last rechoke, not the total
+	c.Update(candidatesOf(peers, []int64{1100, 5000, 0}, nil), false, epoch.Add(CHOKE_INTERVAL))
+	if !c.regular[peers[1]] || c.regular[peers[0]] {
+		t.Fatal("peer 1 sent the most since the last rechoke and should have the slot")
+	}
+	c.Update(candidatesOf(peers, []int64{3000, 5100, 0}, nil), false, epoch.Add(2*CHOKE_INTERVAL))
+	if !c.regular[peers[0]] || c.regular[peers[1]] {
+		t.Fatal("peer 0 sent the most since the last rechoke and should have the slot")
+	}
+
+	// a peer losing interest frees its slot right away
+	candidates := candidatesOf(peers, []int64{3000, 5100, 0}, nil)
+	candidates[0].Interested = false
+	c.Update(candidates, false, epoch.Add(2*CHOKE_INTERVAL+time.Second))
+	if c.regular[peers[0]] || !c.regular[peers[1]] {
+		t.Fatal("slot of the peer no longer interested not handed on")
+	}
+
+	// as does one going away
+	c.Update(candidatesOf(peers[2:], []int64{0}, nil), false, epoch.Add(2*CHOKE_INTERVAL+2*time.Second))
+	if !c.regular[peers[2]] || len(c.regular) != 1 {
+		t.Fatal("slot of the peer that left not handed on")
+	}
+}
+
+func TestChokerOptimisticUnchoke(t *testing.T) {
+	peers := newPeers(5)
+	// peer 0 takes the only regular slot, the others take turns on the optimistic one
+	downloaded := []int64{1000, 0, 0, 0, 0}
+	c := NewChoker(1, rand.New(rand.NewSource(1)))
+
+	now := epoch
+	c.Update(candidatesOf(peers, downloaded, nil), false, now)
+	previous := c.optimistic
+	if previous == nil || previous == peers[0] {
+		t.Fatalf("optimistic unchoke went to %v", previous)
+	}
+
+	for round := 0; round < 6; round++ {
+		// it stays through the rechokes in between
+		for elapsed := CHOKE_INTERVAL; elapsed < OPTIMISTIC_INTERVAL; elapsed += CHOKE_INTERVAL {
+			downloaded[0] += 1000
+			unchoked := c.Update(candidatesOf(peers, downloaded, nil), false, now.Add(elapsed))
+			if c.optimistic != previous || !unchoked[previous] {
+				t.Fatalf("round %d: optimistic unchoke moved after %v", round, elapsed)
+			}
+			if len(unchoked) != 2 {
+				t.Fatalf("round %d: %d peers unchoked, want 2", round, len(unchoked))
+			}
+		}
+
+		now = now.Add(OPTIMISTIC_INTERVAL)
+		downloaded[0] += 1000
+		unchoked := c.Update(candidatesOf(peers, downloaded, nil), false, now)
+		if c.optimistic == previous || c.optimistic == peers[0] {
+			t.Fatalf("round %d: optimistic unchoke didn't move on after %v", round, OPTIMISTIC_INTERVAL)
+		}
+		if unchoked[previous] {
+			t.Fatalf("round %d: previous optimistic unchoke still unchoked", round)
+		}
+		previous = c.optimistic
+	}
+
+	// one losing interest is replaced right away
+	candidates := candidatesOf(peers, downloaded, nil)
+	for i, p := range peers {
+		if p == previous {
+			candidates[i].Interested = false
+		}
+	}
+	c.Update(candidates, false, now.Add(time.Second))
+	if c.optimistic == nil || c.optimistic == previous {
+		t.Fatal("optimistic unchoke not replaced after losing interest")
+	}
+}
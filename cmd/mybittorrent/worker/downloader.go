@@ -1,76 +1,768 @@
 package worker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/extension"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
 )
 
+// MAX_PIECE_RETRIES is how many times a piece failing verification is re-queued before giving up
+const MAX_PIECE_RETRIES = 3
+
+// MAX_PEERS caps the connections of a download, peers connecting to us beyond it are turned away
+const MAX_PEERS = 50
+
+// ACCEPT_BACKLOG is how many peers handed over by Accept may wait for Run to pick them up
+const ACCEPT_BACKLOG = 8
+
+// Downloader hands pieces out to peer connections and collects the verified results.
+// Every peer connection is owned by its own goroutine (see peerConn); the downloader
+// only talks to them through channels and never touches a socket itself.
 type Downloader struct {
-	Peers    []protocol.Peer
-	FullData []byte
-	mu       sync.Mutex
+	Peers   []*protocol.Peer
+	Torrent *torrent.TorrentMetadata
+	// Storage takes every block as it arrives and verifies pieces as they complete
+	Storage      *storage.PieceCache
+	Picker       PiecePicker
+	MaxRetries   int
+	Bans         *BanList
+	BanThreshold int
+	SnubTimeout  time.Duration
+	// Swarm supplies peers connected mid-download and gets told about dropped ones. May be nil
+	Swarm *Swarm
+	// Verified holds the pieces that are on disk and checked
+	Verified protocol.Bitfield
+	// Resume is kept up to date as pieces are verified. May be nil
+	Resume *storage.Resume
+	// Extensions are offered to peers supporting BEP 10. May be nil
+	Extensions *extension.Registry
+	// WebSeeds are HTTP servers holding the payload (BEP 19), downloaded from alongside the peers
+	WebSeeds []string
+	// Seed keeps Run going once every piece is verified, serving peers until ctx is cancelled
+	Seed bool
+	// Choker picks the peers we upload to, its Slots can be changed before Run
+	Choker *Choker
+	// payload totals, carried over between runs through the resume file
+	Downloaded int64
+	Uploaded   int64
+	mu         sync.Mutex
+
+	// pieces were verified since the resume file was last saved
+	dirty bool
+
+	conns map[*protocol.Peer]*peerConn
+	// peers that connected to us, see Accept. Only taken while running
+	accepted chan *protocol.Peer
+	running  bool
+	// peers asking for work, and peers whose goroutine exited
+	idle chan *peerConn
+	gone chan *peerConn
+	// web seeds whose goroutine exited
+	webSeedGone chan *webSeed
+	// nudges the dispatch loop to retry waiting peers, e.g. after a piece was put back
+	wake chan struct{}
+	// closed when Run returns, so peer goroutines never block on the channels above
+	stop <-chan struct{}
+
+	// pieces being downloaded, shared by every peer working on the same piece during endgame
+	pieces map[int]*pieceBuffer
+	// blocks already received for pieces whose peer went away, picked up by the next peer
+	partial map[int]*pieceBuffer
+
+	endgame   bool
+	endgameCh chan struct{}
+
+	// first error writing to storage, ends the download
+	storageErr error
+
+	// failed verification attempts per piece, and the peers that sent the bad data
+	attempts  map[int]int
+	badPeers  map[int]map[*protocol.Peer]bool
+	abandoned map[int]bool
 }
 
-func NewDownloader(peers []protocol.Peer, length int) *Downloader {
-	return &Downloader{
-		Peers:    peers,
-		FullData: make([]byte, length),
-	}
+// pieceBuffer keeps track of the blocks of one piece, possibly coming from several peers.
+// The blocks themselves go straight to storage, whose cache assembles them
+type pieceBuffer struct {
+	index  int
+	length int
+	// held while a block is written, so the write completing the piece is also the last one we counted
+	writing   sync.Mutex
+	received  []bool // per block
+	remaining int
+	peers     map[*protocol.Peer]bool
 }
 
-func (d *Downloader) CloseConnections() {
-	for _, p := range d.Peers {
-		p.Conn.Close()
+func newPieceBuffer(index int, length int) *pieceBuffer {
+	numBlocks := (length + protocol.BLOCK_LENGTH - 1) / protocol.BLOCK_LENGTH
+	return &pieceBuffer{
+		index:     index,
+		length:    length,
+		received:  make([]bool, numBlocks),
+		remaining: numBlocks,
+		peers:     make(map[*protocol.Peer]bool),
 	}
 }
 
-func (d *Downloader) Work(j Job) {
-	dj, ok := j.(*DownloadPieceJob)
+// NewDownloader puts store behind a PieceCache of CACHE_SIZE, unless it is one already
+func NewDownloader(peers []*protocol.Peer, torrent *torrent.TorrentMetadata, picker PiecePicker, store storage.Storage) *Downloader {
+	cache, ok := store.(*storage.PieceCache)
 	if !ok {
-		fmt.Println("Failed to type assert job to DownloadPieceJob")
-		return
+		cache = storage.NewPieceCache(store, torrent.Info, storage.CACHE_SIZE)
+	}
+
+	d := &Downloader{
+		Peers:        peers,
+		Torrent:      torrent,
+		Storage:      cache,
+		Picker:       picker,
+		MaxRetries:   MAX_PIECE_RETRIES,
+		Bans:         NewBanList(),
+		BanThreshold: BAN_THRESHOLD,
+		SnubTimeout:  SNUB_TIMEOUT,
+		Verified:     protocol.NewBitfield(len(torrent.Info.Pieces) / 20),
+		conns:        make(map[*protocol.Peer]*peerConn),
+		accepted:     make(chan *protocol.Peer, ACCEPT_BACKLOG),
+		idle:         make(chan *peerConn),
+		gone:         make(chan *peerConn),
+		webSeedGone:  make(chan *webSeed),
+		wake:         make(chan struct{}, 1),
+		pieces:       make(map[int]*pieceBuffer),
+		partial:      make(map[int]*pieceBuffer),
+		attempts:     make(map[int]int),
+		badPeers:     make(map[int]map[*protocol.Peer]bool),
+		abandoned:    make(map[int]bool),
+		endgameCh:    make(chan struct{}),
+		Choker:       NewChoker(UPLOAD_SLOTS, nil),
+	}
+	d.Extensions = d.newRegistry()
+	return d
+}
+
+// Run starts a goroutine per peer and hands out pieces until everything is verified,
+// no peer can make progress any more, or ctx is cancelled.
+// Connections are closed when it returns.
+func (d *Downloader) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	d.stop = ctx.Done()
+
+	d.mu.Lock()
+	d.running = true
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	// runs last, once no peer goroutine can write any more
+	defer d.saveResume()
+	defer wg.Wait()
+	defer cancel()
+	defer d.refuseAccepted()
+
+	alive := 0
+	start := func(p *protocol.Peer) {
+		if d.Bans.IsBanned(p.IP()) {
+			p.Conn.Close()
+			// the swarm counts it as connected until told otherwise
+			if d.Swarm != nil {
+				d.Swarm.Dropped(p)
+			}
+			return
+		}
+
+		pc := newPeerConn(p, d)
+		d.mu.Lock()
+		d.conns[p] = pc
+		d.mu.Unlock()
+		alive++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pc.run(ctx)
+		}()
+	}
+
+	for _, p := range d.Peers {
+		start(p)
+	}
+	for _, url := range d.WebSeeds {
+		ws := newWebSeed(url, d)
+		alive++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws.run(ctx)
+		}()
+	}
+
+	// only a swarm can bring in new peers
+	var newPeers <-chan *protocol.Peer
+	if d.Swarm != nil {
+		newPeers = d.Swarm.Peers()
 	}
 
-	// first assign a peer to download the piece
-	// TODO: implement a better way to select a peer
-	p := d.Peers[dj.PieceIndex%len(d.Peers)]
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	waiting := make(map[*peerConn]bool)
+
+	for d.Picker.Remaining() > 0 || d.Seed {
+		select {
+		case <-ctx.Done():
+			if d.Seed && d.Picker.Remaining() == 0 {
+				return nil
+			}
+			return ctx.Err()
+		case p := <-newPeers:
+			util.DebugLog("new peer ", p.Addr)
+			start(p)
+		case p := <-d.accepted:
+			util.DebugLog("incoming peer ", p.Addr)
+			start(p)
+		case pc := <-d.idle:
+			waiting[pc] = true
+		case pc := <-d.gone:
+			delete(waiting, pc)
+			alive--
+			if d.Swarm != nil {
+				d.Swarm.Dropped(pc.peer)
+			}
+		case <-d.webSeedGone:
+			alive--
+		case <-d.wake:
+			d.rechoke(time.Now())
+		case <-ticker.C:
+			d.rechoke(time.Now())
+			d.saveResume()
+		}
+
+		for pc := range waiting {
+			if buf := d.assign(pc); buf != nil {
+				pc.work <- buf
+				delete(waiting, pc)
+			}
+		}
 
-	// initialize peer if not already
-	if !p.Init {
-		err := protocol.DownloadInit(p.Conn)
+		d.mu.Lock()
+		err := d.storageErr
+		d.mu.Unlock()
 		if err != nil {
-			fmt.Println("Failed to initialize peer:", err)
+			return err
+		}
+
+		// a seed waits for peers for as long as it takes
+		if d.Picker.Remaining() == 0 {
+			continue
+		}
+
+		// abandoned pieces stay in progress, so once they are all that's left nothing else will happen
+		d.mu.Lock()
+		abandoned := len(d.abandoned)
+		inFlight := len(d.pieces)
+		d.mu.Unlock()
+		if abandoned == d.Picker.Remaining() && inFlight == 0 {
+			return fmt.Errorf("gave up on pieces %v after %d failed attempts each", d.Unverified(), d.MaxRetries+1)
+		}
+
+		pending := d.Swarm != nil && d.Swarm.Pending()
+		if alive == 0 && !pending {
+			return fmt.Errorf("no peers left to download from")
+		}
+
+		// every peer is asking for work, yet nothing is in flight and nothing can be picked
+		d.mu.Lock()
+		stuck := alive > 0 && len(waiting) == alive && len(d.pieces) == 0
+		d.mu.Unlock()
+		if stuck && !pending && d.Picker.Remaining() > 0 {
+			return fmt.Errorf("no peer has any of the remaining %d pieces", d.Picker.Remaining())
+		}
+	}
+
+	return nil
+}
+
+// Accept hands over a peer that connected to us, e.g. from a Listener. The connection is closed
+// and false returned if the download isn't running, has MAX_PEERS already or the peer is banned
+func (d *Downloader) Accept(p *protocol.Peer) bool {
+	d.mu.Lock()
+	full := !d.running || len(d.conns) >= MAX_PEERS
+	d.mu.Unlock()
+
+	if !full && !d.Bans.IsBanned(p.IP()) {
+		select {
+		case d.accepted <- p:
+			return true
+		default:
+		}
+	}
+	p.Conn.Close()
+	return false
+}
+
+// refuseAccepted stops taking peers in and closes those Run didn't get to
+func (d *Downloader) refuseAccepted() {
+	d.mu.Lock()
+	d.running = false
+	d.mu.Unlock()
+
+	for {
+		select {
+		case p := <-d.accepted:
+			p.Conn.Close()
+		default:
 			return
 		}
 	}
+}
+
+// rechoke has the choker decide who we upload to and lets the peers know. Only called by Run
+func (d *Downloader) rechoke(now time.Time) {
+	d.mu.Lock()
+	peers := make([]ChokeCandidate, 0, len(d.conns))
+	conns := make([]*peerConn, 0, len(d.conns))
+	for p, pc := range d.conns {
+		downloaded, uploaded := p.Stats.Transferred()
+		peers = append(peers, ChokeCandidate{Peer: p, Interested: p.Interested, Downloaded: downloaded, Uploaded: uploaded})
+		conns = append(conns, pc)
+	}
+	d.mu.Unlock()
 
-	// request the piece
-	piece := protocol.RequestPiece(p.Conn, dj.Torrent, dj.PieceIndex)
+	unchoked := d.Choker.Update(peers, d.Picker.Remaining() == 0, now)
+	for _, pc := range conns {
+		pc.setChoking(!unchoked[pc.peer])
+	}
+}
 
-	// seems like redundant
+// setInterested records whether the peer wants to download from us, the choker has a look right away
+func (d *Downloader) setInterested(p *protocol.Peer, interested bool) {
+	d.mu.Lock()
+	p.Interested = interested
+	d.mu.Unlock()
+
+	d.notify()
+}
+
+// notify wakes up the dispatch loop without blocking
+func (d *Downloader) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// InEndgame reports whether every remaining piece has already been requested
+func (d *Downloader) InEndgame() bool {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	copiedLen := copy(d.FullData[dj.PieceIndex*dj.Torrent.Info.PieceLength:], piece)
-	util.DebugLog(fmt.Sprintf("Copied %d bytes of piece %d", copiedLen, dj.PieceIndex))
-	if copiedLen != len(piece) {
-		fmt.Println("Failed to copy the piece")
-		// TODO: handle failure gracefully
-		dj.Failed = true
+	return d.endgame
+}
+
+// EndgameStarted is closed once the download enters endgame mode
+func (d *Downloader) EndgameStarted() <-chan struct{} {
+	return d.endgameCh
+}
+
+// checkEndgame switches to endgame once nothing is left to pick; caller holds d.mu
+func (d *Downloader) checkEndgame() {
+	if d.endgame || d.Picker.Wanted() > 0 || d.Picker.Remaining() == 0 {
 		return
 	}
 
-	dj.completed = true
+	util.DebugLog("entering endgame")
+	d.endgame = true
+	close(d.endgameCh)
+}
+
+// usable reports whether a peer may be given work, banned and snubbed peers are skipped
+func (d *Downloader) usable(p *protocol.Peer) bool {
+	return !d.Bans.IsBanned(p.IP()) && !p.Stats.IsSnubbed()
+}
+
+// ban drops a peer that sent failures bad pieces, along with any other connection from the same IP;
+// caller holds d.mu
+func (d *Downloader) ban(p *protocol.Peer, failures int) {
+	ip := p.IP()
+	util.Logger.Printf("Banning peer %s after %d bad pieces\n", ip, failures)
+	d.Bans.Ban(ip)
+
+	// their goroutines notice the closed connection and exit
+	for other := range d.conns {
+		if other.IP() == ip {
+			other.Conn.Close()
+		}
+	}
+}
+
+// peerJoined registers the pieces of a peer that just sent its bitfield
+func (d *Downloader) peerJoined(p *protocol.Peer, bitfield protocol.Bitfield) {
+	d.mu.Lock()
+	p.Bitfield = bitfield
+	p.Init = true
+	d.mu.Unlock()
+
+	d.Picker.PeerJoined(bitfield)
+	d.notify()
+}
+
+func (d *Downloader) peerHave(p *protocol.Peer, index int) {
+	d.mu.Lock()
+	p.Bitfield.Set(index)
+	d.mu.Unlock()
+
+	d.Picker.PeerHave(index)
+	d.notify()
+}
+
+// peerDontHave is lt_donthave, the peer dropped a piece it announced before
+func (d *Downloader) peerDontHave(p *protocol.Peer, index int) {
+	d.mu.Lock()
+	had := p.Init && p.Bitfield.Has(index)
+	if had {
+		p.Bitfield.Clear(index)
+	}
+	d.mu.Unlock()
+
+	if had {
+		d.Picker.PeerDontHave(index)
+	}
 }
 
-type DownloadPieceJob struct {
-	PieceIndex int
-	Torrent    *torrent.TorrentMetadata
-	Hash       string
-	completed  bool
-	Failed     bool
+// peerLeft is called by the peer's goroutine as it exits.
+// Any piece it was working on, or had just been handed, goes back to the pool.
+func (d *Downloader) peerLeft(pc *peerConn) {
+	d.mu.Lock()
+	p := pc.peer
+	if p.Init {
+		d.Picker.PeerLeft(p.Bitfield)
+	}
+	delete(d.conns, p)
+
+	for pieceIndex, buf := range d.pieces {
+		if !buf.peers[p] {
+			continue
+		}
+		delete(buf.peers, p)
+		if len(buf.peers) == 0 {
+			delete(d.pieces, pieceIndex)
+			d.partial[pieceIndex] = buf
+			d.Picker.Abort(pieceIndex)
+		}
+	}
+	d.mu.Unlock()
+
+	downloaded, uploaded := p.Stats.Transferred()
+	util.DebugLog(fmt.Sprintf("peer %s left: %d bytes down at %v average block latency, %d bytes up",
+		p.Addr, downloaded, p.Stats.AvgLatency(), uploaded))
+
+	select {
+	case d.gone <- pc:
+	case <-d.stop:
+	}
+}
+
+// pickable is the peer's bitfield minus the pieces it already sent bad data for,
+// so retries go to a different peer; caller holds d.mu
+func (d *Downloader) pickable(p *protocol.Peer) protocol.Bitfield {
+	bitfield := protocol.Bitfield(p.Bitfield.Marshal())
+	for index, peers := range d.badPeers {
+		if peers[p] {
+			bitfield.Clear(index)
+		}
+	}
+	return bitfield
+}
+
+// Unverified lists the pieces that were given up on after too many failed attempts
+func (d *Downloader) Unverified() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var pieces []int
+	for index := range d.abandoned {
+		pieces = append(pieces, index)
+	}
+	sort.Ints(pieces)
+	return pieces
+}
+
+// assign chooses the next piece for an idle peer, duplicating an in progress piece during endgame
+func (d *Downloader) assign(pc *peerConn) *pieceBuffer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p := pc.peer
+	if _, alive := d.conns[p]; !alive || !p.Init || !d.usable(p) {
+		return nil
+	}
+
+	if index, ok := d.Picker.Pick(d.pickable(p)); ok {
+		return d.startPiece(p, index)
+	}
+
+	d.checkEndgame()
+	if d.endgame {
+		return d.assignDuplicate(p)
+	}
+
+	return nil
+}
+
+// assignWebSeed picks the next piece for a web seed, which only ever gets pieces nobody else is on
+func (d *Downloader) assignWebSeed(p *protocol.Peer) *pieceBuffer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if index, ok := d.Picker.Pick(d.pickable(p)); ok {
+		return d.startPiece(p, index)
+	}
+	d.checkEndgame()
+	return nil
+}
+
+// webSeedLeft is called by the web seed's goroutine as it exits, it is done with its last piece by then
+func (d *Downloader) webSeedLeft(ws *webSeed) {
+	d.Picker.PeerLeft(ws.peer.Bitfield)
+
+	select {
+	case d.webSeedGone <- ws:
+	case <-d.stop:
+	}
+}
+
+// assignDuplicate has the peer also download a piece that is already in progress elsewhere.
+// Pieces with the fewest peers on them go first; caller holds d.mu
+func (d *Downloader) assignDuplicate(p *protocol.Peer) *pieceBuffer {
+	var best *pieceBuffer
+	for _, index := range d.Picker.InProgress() {
+		buf, ok := d.pieces[index]
+		if !ok || buf.peers[p] || d.badPeers[index][p] || !p.Bitfield.Has(index) {
+			continue
+		}
+
+		if best == nil || len(buf.peers) < len(best.peers) {
+			best = buf
+		}
+	}
+
+	if best != nil {
+		best.peers[p] = true
+	}
+	return best
+}
+
+// startPiece sets up the buffer for a freshly picked piece; caller holds d.mu
+func (d *Downloader) startPiece(p *protocol.Peer, pieceIndex int) *pieceBuffer {
+	// carry on from where a snubbing peer left off
+	buf, ok := d.partial[pieceIndex]
+	if ok {
+		delete(d.partial, pieceIndex)
+	} else {
+		buf = newPieceBuffer(pieceIndex, d.Torrent.Info.PieceSize(pieceIndex))
+	}
+	buf.peers[p] = true
+	d.pieces[pieceIndex] = buf
+	d.checkEndgame()
+	return buf
+}
+
+// received reports whether a block of the piece is already in
+func (d *Downloader) received(buf *pieceBuffer, begin int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return buf.received[begin/protocol.BLOCK_LENGTH]
+}
+
+// blockReceived writes a block to storage and tells the other peers on the same piece to cancel it.
+// The write completing the piece has it verified by the cache
+func (d *Downloader) blockReceived(p *protocol.Peer, buf *pieceBuffer, begin int, block []byte) {
+	buf.writing.Lock()
+	defer buf.writing.Unlock()
+
+	d.mu.Lock()
+	blockIndex := begin / protocol.BLOCK_LENGTH
+	if buf.received[blockIndex] {
+		d.mu.Unlock()
+		return
+	}
+
+	buf.received[blockIndex] = true
+	buf.remaining--
+	complete := buf.remaining == 0
+	d.Downloaded += int64(len(block))
+
+	for other := range buf.peers {
+		if other == p {
+			continue
+		}
+		if pc, ok := d.conns[other]; ok {
+			pc.cancelBlock(buf.index, begin)
+		}
+	}
+	d.mu.Unlock()
+
+	_, err := d.Storage.WriteAt(buf.index, block, begin)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if complete {
+		d.completePiece(p, buf, err)
+	} else if err != nil {
+		d.failStorage(fmt.Errorf("Error writing block %d:%d: %v", buf.index, begin, err))
+	}
+}
+
+// completePiece handles the outcome of verifying a piece whose last block was just written; caller holds d.mu
+func (d *Downloader) completePiece(p *protocol.Peer, buf *pieceBuffer, err error) {
+	defer d.notify()
+
+	pieceIndex := buf.index
+	// the peers still on it notice the piece is gone once they finish up
+	delete(d.pieces, pieceIndex)
+
+	if errors.Is(err, storage.ErrHashMismatch) {
+		util.Logger.Printf("Sha1 Checksum for Piece %d does not match\n", pieceIndex)
+		d.retry(p, pieceIndex)
+		return
+	}
+	if err != nil {
+		d.failStorage(fmt.Errorf("Error writing piece %d: %v", pieceIndex, err))
+		d.Picker.Abort(pieceIndex)
+		return
+	}
+
+	util.DebugLog(fmt.Sprintf("Verified piece %d", pieceIndex))
+	d.Picker.Done(pieceIndex)
+	d.Verified.Set(pieceIndex)
+	d.dirty = true
+
+	// every peer gets to know, so they can ask us for it
+	for _, pc := range d.conns {
+		pc.announce()
+	}
+}
+
+// failStorage records the first storage error, which ends the download; caller holds d.mu
+func (d *Downloader) failStorage(err error) {
+	if d.storageErr == nil {
+		d.storageErr = err
+	}
+}
+
+// finishPiece is called once the peer has nothing more to fetch for the piece, or gave up on it.
+// A piece nobody is working on any more goes back to the pool, keeping the blocks already received
+func (d *Downloader) finishPiece(p *protocol.Peer, buf *pieceBuffer) {
+	defer d.notify()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(buf.peers, p)
+	pieceIndex := buf.index
+
+	if d.pieces[pieceIndex] != buf {
+		// completed, or another peer already gave up on it
+		return
+	}
+
+	if buf.remaining > 0 && len(buf.peers) == 0 {
+		delete(d.pieces, pieceIndex)
+		d.partial[pieceIndex] = buf
+		d.Picker.Abort(pieceIndex)
+	}
+}
+
+// has reports whether a piece is verified and can be served
+func (d *Downloader) has(index int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.Verified.Has(index)
+}
+
+// verified returns a copy of the pieces verified so far
+func (d *Downloader) verified() protocol.Bitfield {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return protocol.Bitfield(d.Verified.Marshal())
+}
+
+// blockSent counts a block we served towards the upload totals
+func (d *Downloader) blockSent(p *protocol.Peer, length int) {
+	p.Stats.AddUpload(length)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Uploaded += int64(length)
+}
+
+// saveResume records the verified pieces, known peers and totals in the resume file.
+// Storage is flushed first, so the resume file never claims a piece that isn't on disk
+func (d *Downloader) saveResume() {
+	if d.Resume == nil {
+		return
+	}
+
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return
+	}
+	data := storage.ResumeData{
+		Verified:   protocol.Bitfield(d.Verified.Marshal()),
+		Downloaded: d.Downloaded,
+		Uploaded:   d.Uploaded,
+	}
+	d.dirty = false
+	d.mu.Unlock()
+
+	if d.Swarm != nil {
+		data.Peers = d.Swarm.Known()
+	}
+
+	err := d.Storage.Flush()
+	if err == nil {
+		err = d.Resume.Save(data)
+	}
+	if err != nil {
+		util.Logger.Println("Error saving resume file:", err)
+		d.mu.Lock()
+		d.dirty = true
+		d.mu.Unlock()
+	}
+}
+
+// retry puts a piece that failed verification back into the pool, excluding the peer that sent it.
+// After MaxRetries attempts the piece is abandoned: it stays in progress so it is never picked again,
+// and shows up in Unverified. Caller holds d.mu
+func (d *Downloader) retry(p *protocol.Peer, pieceIndex int) {
+	// in endgame several peers may have contributed blocks, but blame the one that completed the piece
+	if d.badPeers[pieceIndex] == nil {
+		d.badPeers[pieceIndex] = make(map[*protocol.Peer]bool)
+	}
+	d.badPeers[pieceIndex][p] = true
+	if failures := p.Stats.AddHashFailure(); failures >= d.BanThreshold {
+		d.ban(p, failures)
+	}
+
+	d.attempts[pieceIndex]++
+	if d.attempts[pieceIndex] > d.MaxRetries {
+		util.Logger.Printf("Giving up on piece %d after %d attempts\n", pieceIndex, d.attempts[pieceIndex])
+		d.abandoned[pieceIndex] = true
+		return
+	}
+
+	d.Picker.Abort(pieceIndex)
 }
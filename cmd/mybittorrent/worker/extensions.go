@@ -0,0 +1,225 @@
+package worker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/extension"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// newRegistry sets up the extensions every peer of the download is offered
+func (d *Downloader) newRegistry() *extension.Registry {
+	registry := extension.NewRegistry()
+	registry.Reqq = protocol.MAX_PIPELINE
+
+	// peers that only have the magnet link can get the info dictionary from us
+	metadata := []byte(torrent.EncodeInfoDict(d.Torrent.Info))
+	registry.MetadataSize = len(metadata)
+	registry.Register(extension.ServeMetadata(metadata))
+
+	registry.Register(extension.Extension{
+		Name: extension.LT_DONTHAVE,
+		Handle: func(s *extension.Session, payload []byte) error {
+			if len(payload) != 4 {
+				return fmt.Errorf("invalid payload of %d bytes", len(payload))
+			}
+			d.peerDontHave(s.Peer, int(binary.BigEndian.Uint32(payload)))
+			return nil
+		},
+	})
+
+	registry.Register(extension.Extension{
+		Name: extension.UPLOAD_ONLY,
+		Joined: func(s *extension.Session) error {
+			uploadOnly, _ := s.Remote().Dict[extension.UPLOAD_ONLY].(int)
+			return d.setUploadOnly(s.Peer, uploadOnly != 0)
+		},
+		Handle: func(s *extension.Session, payload []byte) error {
+			if len(payload) != 1 {
+				return fmt.Errorf("invalid payload of %d bytes", len(payload))
+			}
+			return d.setUploadOnly(s.Peer, payload[0] != 0)
+		},
+	})
+
+	registry.Register(extension.Extension{
+		Name: extension.UT_PEX,
+		Handle: func(s *extension.Session, payload []byte) error {
+			return d.receivePex(s.Peer, payload)
+		},
+	})
+
+	registry.Register(extension.Extension{
+		Name: extension.UT_HOLEPUNCH,
+		Handle: func(s *extension.Session, payload []byte) error {
+			return d.receiveHolepunch(s, payload)
+		},
+	})
+
+	return registry
+}
+
+// receivePex feeds the peers a peer told us about into the candidate pool.
+// Runs on the peer's goroutine, like everything dispatched from its messages
+func (d *Downloader) receivePex(p *protocol.Peer, payload []byte) error {
+	msg, err := extension.ParsePex(payload)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	pc := d.conns[p]
+	d.mu.Unlock()
+	if pc == nil || pc.pex == nil {
+		return nil
+	}
+	if !pc.pex.Received(time.Now()) {
+		util.DebugLog("ignoring ut_pex message sent too soon by ", p.IP())
+		return nil
+	}
+
+	if d.Swarm == nil {
+		return nil
+	}
+	addrs := make([]string, 0, len(msg.Added))
+	for _, added := range msg.Added {
+		addrs = append(addrs, added.Addr)
+	}
+	d.Swarm.AddCandidates(addrs, SourcePEX)
+	return nil
+}
+
+// receiveHolepunch handles ut_holepunch (BEP 55). As the relay of a rendezvous we tell both peers
+// to connect to each other, a connect has the address tried like any other candidate
+func (d *Downloader) receiveHolepunch(s *extension.Session, payload []byte) error {
+	msg, err := extension.ParseHolepunch(payload)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case extension.HOLEPUNCH_CONNECT:
+		if d.Swarm != nil {
+			d.Swarm.AddCandidates([]string{msg.Addr}, SourceHolepunch)
+		}
+	case extension.HOLEPUNCH_ERROR:
+		util.DebugLog(fmt.Sprintf("ut_holepunch to %s failed with error %d", msg.Addr, msg.ErrCode))
+	case extension.HOLEPUNCH_RENDEZVOUS:
+		return d.relayHolepunch(s, msg.Addr)
+	}
+	return nil
+}
+
+// relayHolepunch sends a connect to the initiator of a rendezvous and to its target,
+// or an error back to the initiator if the target can't be reached through us
+func (d *Downloader) relayHolepunch(s *extension.Session, target string) error {
+	d.mu.Lock()
+	// without a listen port, where it connected from is the best we have
+	initiator := reachableAddr(s.Peer)
+	if initiator == "" {
+		initiator = s.Peer.Addr
+	}
+	var targetSession *extension.Session
+	errCode := uint32(extension.HOLEPUNCH_NOT_CONNECTED)
+	if target == initiator {
+		errCode = extension.HOLEPUNCH_NO_SELF
+	} else {
+		for other, pc := range d.conns {
+			if other == s.Peer || reachableAddr(other) != target {
+				continue
+			}
+			errCode = extension.HOLEPUNCH_NO_SUPPORT
+			if pc.ext != nil && pc.ext.Supports(extension.UT_HOLEPUNCH) {
+				targetSession = pc.ext
+			}
+			break
+		}
+	}
+	d.mu.Unlock()
+
+	if targetSession == nil {
+		reply, err := extension.HolepunchMessage{Type: extension.HOLEPUNCH_ERROR, Addr: target, ErrCode: errCode}.Encode()
+		if err != nil {
+			return err
+		}
+		return s.Send(extension.UT_HOLEPUNCH, reply)
+	}
+
+	toTarget, err := extension.HolepunchMessage{Type: extension.HOLEPUNCH_CONNECT, Addr: initiator}.Encode()
+	if err != nil {
+		return err
+	}
+	toInitiator, err := extension.HolepunchMessage{Type: extension.HOLEPUNCH_CONNECT, Addr: target}.Encode()
+	if err != nil {
+		return err
+	}
+	if err := targetSession.Send(extension.UT_HOLEPUNCH, toTarget); err != nil {
+		util.DebugLog("relaying ut_holepunch failed: ", err)
+	}
+	return s.Send(extension.UT_HOLEPUNCH, toInitiator)
+}
+
+// reachableAddr is where a peer accepts connections: a peer that connected to us can only be reached
+// on the port it told us it listens on, empty if it didn't; caller holds d.mu
+func reachableAddr(p *protocol.Peer) string {
+	if p.Incoming {
+		return p.ListenAddr
+	}
+	return p.Addr
+}
+
+// pexPeers lists the peers we are connected to, other than p, as ut_pex advertises them
+func (d *Downloader) pexPeers(p *protocol.Peer) []extension.PexPeer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	numPieces := len(d.Torrent.Info.Pieces) / 20
+	peers := make([]extension.PexPeer, 0, len(d.conns))
+	for other, pc := range d.conns {
+		addr, flags := reachableAddr(other), byte(extension.PEX_OUTGOING)
+		if other.Incoming {
+			flags = 0
+		}
+		if pc.ext != nil && pc.ext.Supports(extension.UT_HOLEPUNCH) {
+			flags |= extension.PEX_HOLEPUNCH
+		}
+		if other == p || addr == "" {
+			continue
+		}
+		if other.UploadOnly || (other.Init && other.Bitfield.Count() == numPieces) {
+			flags |= extension.PEX_SEED
+		}
+		peers = append(peers, extension.PexPeer{Addr: addr, Flags: flags})
+	}
+	return peers
+}
+
+// setListenPort records where an incoming peer accepts connections, from the p of its extended handshake
+func (d *Downloader) setListenPort(p *protocol.Peer, port int) {
+	if port <= 0 || port > 65535 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p.ListenAddr = net.JoinHostPort(p.IP(), strconv.Itoa(port))
+}
+
+// setUploadOnly records that the peer won't download anything. Once we have everything too
+// there is nothing either side can do for the other, so the error has the peer dropped
+func (d *Downloader) setUploadOnly(p *protocol.Peer, uploadOnly bool) error {
+	d.mu.Lock()
+	p.UploadOnly = uploadOnly
+	d.mu.Unlock()
+
+	if uploadOnly && d.Picker.Remaining() == 0 {
+		return fmt.Errorf("upload only peer while we are seeding")
+	}
+	return nil
+}
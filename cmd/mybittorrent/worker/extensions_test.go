@@ -0,0 +1,153 @@
+package worker
+
+import (
+	"crypto/sha1"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/extension"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+// malformedPayloads are extension message bodies no handler should take, or at least not crash on
+var malformedPayloads = []string{
+	"", "d", "l", "i", "i-e", "d1:a", "x", "\xff\xff\xff\xff", "\x00",
+	"le", "i1e", "d1:mi1ee", "d1:md11:ut_metadatai-1eee", "d1:pi99999e6:yourip1:xe",
+	"d8:msg_typei0ee", "d8:msg_typei0e5:piecei-1ee", "d8:msg_typei0e5:piecei99999ee", "d8:msg_typei9e5:piecei0ee",
+	"d5:added5:abcde7:added.f1:xe", "d6:added63:abce", "d7:dropped1:xe", "d5:addedi1ee",
+	// ut_holepunch: unknown message and address types, short, no port, an error without a code, and a rendezvous to nobody
+	"\x03\x00\x7f\x00\x00\x01\x1a\xe1\x00\x00\x00\x00", "\x00\x02\x7f\x00\x00\x01\x1a\xe1\x00\x00\x00\x00",
+	"\x00\x01\x7f\x00\x00\x01\x1a\xe1\x00\x00\x00\x00", "\x00\x00\x7f\x00\x00\x01\x00\x00\x00\x00\x00\x00",
+	"\x02\x00\x7f\x00\x00\x01\x1a\xe1\x00\x00\x00\x00", "\x00\x00\x7f\x00\x00\x01\x1a\xe1\x00\x00\x00\x00",
+}
+
+// testDownloader is a downloader of a one piece torrent, nothing is ever read from its storage
+func testDownloader() *Downloader {
+	data := make([]byte, 1000)
+	hash := sha1.Sum(data)
+	tm := &torrent.TorrentMetadata{Info: torrent.InfoDict{Name: "x", Length: len(data), PieceLength: len(data), Pieces: hash[:]}}
+	store := storage.NewPieceCache(nil, tm.Info, 0)
+	return NewDownloader(nil, tm, NewSequentialPicker(1), store)
+}
+
+func TestExtensionsMalformedPayloads(t *testing.T) {
+	d := testDownloader()
+	// the peer offers everything we do, so every handler is reached
+	_, s, _ := testPeer(t, d, "10.0.0.1:6881")
+	handshake := d.Extensions.Handshake(nil)
+
+	ids := map[string]int{"handshake": extension.EXTENDED_HANDSHAKE_ID, "unknown": 255}
+	for name, id := range handshake.M {
+		ids[name] = id
+	}
+	for name, id := range ids {
+		for _, payload := range malformedPayloads {
+			// errors are fine, they get the peer dropped, panics would take everyone down
+			s.Handle(append([]byte{byte(id)}, payload...))
+		}
+		t.Logf("%s survived %d malformed payloads", name, len(malformedPayloads))
+	}
+
+	// the mangled handshakes didn't take anything away
+	if !s.Ready() || !s.Supports(extension.UT_PEX) {
+		t.Fatal("malformed handshakes undid the valid one")
+	}
+}
+
+// testPeer connects a peer with the given address to d, its extended handshake offering what d does.
+// Returns the peer, its session and the payloads of the extended messages it is sent, each starting with the id
+func testPeer(t *testing.T, d *Downloader, addr string) (*protocol.Peer, *extension.Session, *[][]byte) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	p := &protocol.Peer{Addr: addr, Conn: conn, Stats: protocol.NewPeerStats(), Extensions: true}
+	var sent [][]byte
+	s := d.Extensions.NewSession(conn, p, func(msg protocol.Message) error {
+		sent = append(sent, msg.Payload)
+		return nil
+	})
+	msg, err := extension.NewExtendedHandshakeMessage(d.Extensions.Handshake(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Handle(msg.Payload); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := newPeerConn(p, d)
+	pc.ext = s
+	pc.pex = extension.NewPexState()
+	d.conns[p] = pc
+	return p, s, &sent
+}
+
+// holepunchSent parses the ut_holepunch messages among the payloads a peer was sent
+func holepunchSent(t *testing.T, d *Downloader, sent [][]byte) []extension.HolepunchMessage {
+	t.Helper()
+
+	id := d.Extensions.Handshake(nil).M[extension.UT_HOLEPUNCH]
+	var messages []extension.HolepunchMessage
+	for _, payload := range sent {
+		if int(payload[0]) != id {
+			continue
+		}
+		m, err := extension.ParseHolepunch(payload[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func TestHolepunchRelay(t *testing.T) {
+	d := testDownloader()
+	_, initiator, initiatorSent := testPeer(t, d, "10.0.0.1:6881")
+	_, _, targetSent := testPeer(t, d, "10.0.0.2:6881")
+	id := byte(d.Extensions.Handshake(nil).M[extension.UT_HOLEPUNCH])
+
+	rendezvous := func(target string) {
+		t.Helper()
+		payload, err := extension.HolepunchMessage{Type: extension.HOLEPUNCH_RENDEZVOUS, Addr: target}.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := initiator.Handle(append([]byte{id}, payload...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rendezvous("10.0.0.2:6881")
+	got := holepunchSent(t, d, *initiatorSent)
+	if len(got) != 1 || got[0].Type != extension.HOLEPUNCH_CONNECT || got[0].Addr != "10.0.0.2:6881" {
+		t.Fatalf("initiator was sent %+v, want a connect to the target", got)
+	}
+	got = holepunchSent(t, d, *targetSent)
+	if len(got) != 1 || got[0].Type != extension.HOLEPUNCH_CONNECT || got[0].Addr != "10.0.0.1:6881" {
+		t.Fatalf("target was sent %+v, want a connect to the initiator", got)
+	}
+
+	for target, errCode := range map[string]uint32{
+		"10.0.0.3:6881": extension.HOLEPUNCH_NOT_CONNECTED,
+		"10.0.0.1:6881": extension.HOLEPUNCH_NO_SELF,
+	} {
+		*initiatorSent = nil
+		rendezvous(target)
+		got := holepunchSent(t, d, *initiatorSent)
+		if len(got) != 1 || got[0].Type != extension.HOLEPUNCH_ERROR || got[0].ErrCode != errCode {
+			t.Fatalf("rendezvous with %s answered with %+v, want error %d", target, got, errCode)
+		}
+	}
+}
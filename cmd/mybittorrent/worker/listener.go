@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// Listener accepts connections from peers and hands each to the download of the torrent it asks for
+type Listener struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	downloads map[string]*Downloader // keyed by info hash
+}
+
+// Listen opens the port peers connect to, e.g. ":6881"
+func Listen(addr string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, downloads: make(map[string]*Downloader)}, nil
+}
+
+// Port is the TCP port we listen on
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Add serves the download's torrent to peers connecting from now on.
+// Its extended handshake tells peers where to connect back to
+func (l *Listener) Add(d *Downloader) {
+	if d.Extensions != nil {
+		d.Extensions.Port = l.Port()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.downloads[string(d.Torrent.Info.Hash())] = d
+}
+
+func (l *Listener) download(infoHash []byte) *Downloader {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.downloads[string(infoHash)]
+}
+
+// Run accepts connections until ctx is cancelled, then closes the port
+func (l *Listener) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		l.ln.Close()
+	}()
+
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// e.g. out of file descriptors, which may be over in a moment
+			util.DebugLog("accepting connection failed: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake answers the peer's handshake if we serve the torrent it asks for
+func (l *Listener) handshake(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	p, infoHash, err := protocol.AcceptPeer(tcpConn, func(infoHash []byte) bool {
+		return l.download(infoHash) != nil
+	})
+	if err != nil {
+		util.DebugLog("incoming handshake failed: ", conn.RemoteAddr(), err)
+		return
+	}
+
+	d := l.download(infoHash)
+	if d == nil {
+		p.Conn.Close()
+		return
+	}
+	if !d.Accept(p) {
+		util.DebugLog("turning away peer ", p.Addr)
+	}
+}
@@ -0,0 +1,533 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/extension"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// WRITE_TIMEOUT is how long a single write may take before the peer is considered stalled and dropped
+const WRITE_TIMEOUT = 30 * time.Second
+
+// MAX_QUEUED_PIECES is how many blocks we hold for a peer waiting to be written.
+// That's twice the reqq we advertise, requests beyond it are dropped without reading from storage
+const MAX_QUEUED_PIECES = 2 * protocol.MAX_PIPELINE
+
+// blockRef identifies a block of a piece
+type blockRef struct {
+	index int
+	begin int
+}
+
+// peerConn owns a single peer connection.
+// Only its reader loop reads from the socket and only its writer loop writes to it;
+// everything else happens in run, which gets pieces handed over on the work channel.
+type peerConn struct {
+	peer *protocol.Peer
+	d    *Downloader
+
+	incoming chan protocol.Message
+	outgoing chan protocol.Message
+	// piece messages in outgoing, counted up by serve and down by the writer loop
+	queuedPieces atomic.Int32
+	work         chan *pieceBuffer
+	cancels      chan blockRef
+	// nudged when we verified a piece, see announce
+	haves chan struct{}
+	// the choker's latest decision, see setChoking
+	chokes chan bool
+	done   chan struct{}
+	// closed when the writer loop exits, nothing sent after that goes anywhere
+	writerDone chan struct{}
+
+	// extension protocol state, nil if the peer or the downloader doesn't do BEP 10.
+	// Only set by run, others read it under d.mu
+	ext *extension.Session
+	pex *extension.PexState
+
+	// the rest is only touched by run
+	choked     bool
+	interested bool
+	waiting    bool // asked the downloader for work and hasn't got any yet
+	piece      *pieceBuffer
+	next       int // offset of the next block to request
+	// outstanding requests keyed by begin offset, with the time they were sent
+	outstanding map[int]int
+	requestedAt map[int]time.Time
+	lastBlock   time.Time
+	snubbedAt   time.Time
+
+	// our side of the upload: whether we choke the peer, and the pieces we told it about
+	choking   bool
+	announced protocol.Bitfield
+}
+
+func newPeerConn(p *protocol.Peer, d *Downloader) *peerConn {
+	return &peerConn{
+		peer:        p,
+		d:           d,
+		incoming:    make(chan protocol.Message),
+		outgoing:    make(chan protocol.Message, 2*protocol.MAX_PIPELINE),
+		work:        make(chan *pieceBuffer, 1),
+		cancels:     make(chan blockRef, 4*protocol.MAX_PIPELINE),
+		haves:       make(chan struct{}, 1),
+		chokes:      make(chan bool, 1),
+		done:        make(chan struct{}),
+		writerDone:  make(chan struct{}),
+		choked:      true,
+		choking:     true,
+		outstanding: make(map[int]int),
+		requestedAt: make(map[int]time.Time),
+	}
+}
+
+// readLoop is the only place reading from the socket
+func (pc *peerConn) readLoop() {
+	defer close(pc.incoming)
+
+	for {
+		msg, err := protocol.ReadMessage(pc.peer.Conn)
+		if err != nil {
+			util.DebugLog("read from peer failed: ", pc.peer.IP(), err)
+			return
+		}
+
+		select {
+		case pc.incoming <- msg:
+		case <-pc.done:
+			return
+		}
+	}
+}
+
+// writeLoop is the only place writing to the socket.
+// A peer that stops reading would otherwise block it forever, so every write has a deadline
+func (pc *peerConn) writeLoop() {
+	defer close(pc.writerDone)
+
+	for {
+		select {
+		case msg := <-pc.outgoing:
+			pc.peer.Conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			_, err := pc.peer.Conn.Write(msg.Encode())
+			if err != nil {
+				util.DebugLog("write to peer failed: ", pc.peer.IP(), err)
+				// unblocks the reader, which ends run
+				pc.peer.Conn.Close()
+				return
+			}
+			if msg.Id == protocol.MsgPiece {
+				pc.queuedPieces.Add(-1)
+			}
+		case <-pc.done:
+			return
+		}
+	}
+}
+
+// send queues a message for the writer loop. It gives up once the writer is gone or the download stops,
+// run notices either soon after
+func (pc *peerConn) send(msg protocol.Message) {
+	select {
+	case pc.outgoing <- msg:
+	case <-pc.writerDone:
+	case <-pc.done:
+	case <-pc.d.stop:
+	}
+}
+
+// announce has the peer told about pieces we verified since. Never blocks
+func (pc *peerConn) announce() {
+	select {
+	case pc.haves <- struct{}{}:
+	default:
+	}
+}
+
+// setChoking passes on whether the choker wants the peer choked. Only a decision not acted on yet
+// is replaced, so it never blocks as long as Run is the only caller
+func (pc *peerConn) setChoking(choke bool) {
+	select {
+	case <-pc.chokes:
+	default:
+	}
+	pc.chokes <- choke
+}
+
+// cancelBlock asks the peer to drop a request that was fulfilled by someone else.
+// Called from other goroutines, so it must never block
+func (pc *peerConn) cancelBlock(index int, begin int) {
+	select {
+	case pc.cancels <- blockRef{index: index, begin: begin}:
+	default:
+		// the late block will simply be dropped when it arrives
+	}
+}
+
+func (pc *peerConn) run(ctx context.Context) {
+	defer pc.d.peerLeft(pc)
+	defer pc.peer.Conn.Close()
+	defer close(pc.done)
+
+	go pc.readLoop()
+	go pc.writeLoop()
+
+	// the bitfield has to be the first message, peers with nothing may skip it
+	pc.announced = pc.d.verified()
+	if pc.announced.Count() > 0 {
+		pc.send(protocol.Message{Id: protocol.MsgBitfield, Payload: pc.announced.Marshal()})
+	}
+
+	if pc.peer.Extensions && pc.d.Extensions != nil {
+		ext := pc.d.Extensions.NewSession(pc.peer.Conn, pc.peer, func(msg protocol.Message) error {
+			pc.send(msg)
+			return nil
+		})
+		if err := ext.Start(); err != nil {
+			util.DebugLog("extended handshake failed: ", pc.peer.IP(), err)
+			ext = nil
+		}
+		// other peers' goroutines look at the session under d.mu, to relay ut_holepunch messages
+		pc.d.mu.Lock()
+		pc.ext = ext
+		pc.pex = extension.NewPexState()
+		pc.d.mu.Unlock()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-pc.incoming:
+			if !ok {
+				util.Logger.Printf("Peer %s disconnected\n", pc.peer.IP())
+				return
+			}
+			if err := pc.handle(msg); err != nil {
+				util.Logger.Printf("Dropping peer %s: %v\n", pc.peer.IP(), err)
+				return
+			}
+		case buf := <-pc.work:
+			pc.waiting = false
+			pc.start(buf)
+		case ref := <-pc.cancels:
+			pc.cancel(ref)
+		case <-pc.haves:
+			pc.sendHaves()
+		case choke := <-pc.chokes:
+			pc.choke(choke)
+		case <-ticker.C:
+			pc.checkSnubbed()
+			pc.sendPex()
+		}
+	}
+}
+
+func (pc *peerConn) handle(msg protocol.Message) error {
+	// may come before or after the bitfield
+	if msg.Id == protocol.MsgExtended {
+		if pc.ext == nil {
+			util.DebugLog("Ignoring extended message from peer: ", pc.peer.IP())
+			return nil
+		}
+		err := pc.ext.Handle(msg.Payload)
+		if pc.peer.Incoming && pc.ext.Ready() {
+			pc.d.setListenPort(pc.peer, pc.ext.Remote().Port)
+		}
+		return err
+	}
+
+	// the bitfield is only allowed as the very first message; peers with nothing may skip it
+	if !pc.peer.Init {
+		numPieces := len(pc.d.Torrent.Info.Pieces) / 20
+		bitfield := protocol.NewBitfield(numPieces)
+		if msg.Id == protocol.MsgBitfield {
+			bf, err := protocol.UnmarshalBitfield(msg.Payload, numPieces)
+			if err != nil {
+				return err
+			}
+			bitfield = bf
+		}
+		pc.d.peerJoined(pc.peer, bitfield)
+
+		// a seed has nothing to ask for
+		if pc.d.Picker.Remaining() > 0 {
+			pc.interested = true
+			pc.send(protocol.Message{Id: protocol.MsgInterested})
+			util.DebugLog("Sent interested message")
+		}
+
+		if msg.Id == protocol.MsgBitfield {
+			return nil
+		}
+	}
+
+	switch msg.Id {
+	case protocol.MsgBitfield:
+		return fmt.Errorf("unexpected bitfield message")
+	case protocol.MsgHave:
+		index, err := protocol.ParseHaveMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		pc.d.peerHave(pc.peer, index)
+	case protocol.MsgChoke:
+		pc.choked = true
+		// requests are dropped by a choking peer, let someone else have the piece
+		pc.release()
+	case protocol.MsgUnchoke:
+		pc.choked = false
+		pc.requestWork()
+	case protocol.MsgPiece:
+		index, begin, block, err := protocol.ParsePieceMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		pc.receive(index, begin, block)
+	case protocol.MsgInterested:
+		pc.d.setInterested(pc.peer, true)
+	case protocol.MsgNotInterested:
+		pc.d.setInterested(pc.peer, false)
+	case protocol.MsgRequest:
+		return pc.serve(msg.Payload)
+	case protocol.MsgCancel:
+		// requests are answered as soon as they come in, there is nothing left to cancel
+	default:
+		util.DebugLog("Ignoring message from peer: ", msg.Id)
+	}
+
+	return nil
+}
+
+// choke tells the peer whether we stopped or started uploading to it
+func (pc *peerConn) choke(choke bool) {
+	if choke == pc.choking {
+		return
+	}
+
+	pc.choking = choke
+	if choke {
+		pc.send(protocol.Message{Id: protocol.MsgChoke})
+	} else {
+		pc.send(protocol.Message{Id: protocol.MsgUnchoke})
+	}
+}
+
+// serve answers a request with the block read from storage.
+// A peer asking for more than MAX_QUEUED_PIECES blocks at once gets the extra requests dropped
+func (pc *peerConn) serve(payload []byte) error {
+	index, begin, length, err := protocol.ParseRequestMessage(payload)
+	if err != nil {
+		return err
+	}
+	// sent before our choke arrived, the peer knows these are dropped
+	if pc.choking {
+		return nil
+	}
+
+	if length <= 0 || length > protocol.MAX_REQUEST_LENGTH {
+		return fmt.Errorf("request for %d bytes", length)
+	}
+	if !pc.d.has(index) {
+		return fmt.Errorf("request for piece %d we don't have", index)
+	}
+	if begin < 0 || begin+length > pc.d.Torrent.Info.PieceSize(index) {
+		return fmt.Errorf("request for %d:%d past the end of the piece", index, begin)
+	}
+
+	if pc.queuedPieces.Load() >= MAX_QUEUED_PIECES {
+		util.DebugLog(fmt.Sprintf("dropping request %d:%d from %s, too many blocks queued", index, begin, pc.peer.IP()))
+		return nil
+	}
+
+	block := make([]byte, length)
+	_, err = pc.d.Storage.ReadAt(index, block, begin)
+	if err != nil {
+		util.Logger.Printf("Reading block %d:%d for peer %s failed: %v\n", index, begin, pc.peer.IP(), err)
+		return nil
+	}
+
+	pc.queuedPieces.Add(1)
+	pc.send(protocol.NewPieceMessage(index, begin, block))
+	pc.d.blockSent(pc.peer, length)
+	return nil
+}
+
+// sendHaves tells the peer about the pieces verified since the last time
+func (pc *peerConn) sendHaves() {
+	verified := pc.d.verified()
+	for index := 0; index < len(verified)*8; index++ {
+		if verified.Has(index) && !pc.announced.Has(index) {
+			pc.announced.Set(index)
+			pc.send(protocol.NewHaveMessage(index))
+		}
+	}
+}
+
+// requestWork lets the downloader know we can take a piece
+func (pc *peerConn) requestWork() {
+	if pc.choked || pc.piece != nil || pc.waiting || !pc.d.usable(pc.peer) {
+		return
+	}
+
+	pc.waiting = true
+	select {
+	case pc.d.idle <- pc:
+	case <-pc.d.stop:
+	}
+}
+
+func (pc *peerConn) start(buf *pieceBuffer) {
+	if pc.choked {
+		// got choked while the piece was on its way
+		pc.d.finishPiece(pc.peer, buf)
+		return
+	}
+
+	pc.piece = buf
+	pc.next = 0
+	pc.lastBlock = time.Now()
+	pc.fill()
+}
+
+// fill keeps up to pipeline requests in flight for the current piece
+func (pc *peerConn) fill() {
+	buf := pc.piece
+	pipeline := pc.pipeline()
+	for len(pc.outstanding) < pipeline && pc.next < buf.length {
+		begin := pc.next
+		blockLength := protocol.BLOCK_LENGTH
+		if begin+blockLength > buf.length {
+			blockLength = buf.length - begin
+		}
+		pc.next += blockLength
+
+		// in endgame another peer may have delivered it already
+		if pc.d.received(buf, begin) {
+			continue
+		}
+
+		pc.send(protocol.NewRequestMessage(buf.index, begin, blockLength))
+		pc.outstanding[begin] = blockLength
+		pc.requestedAt[begin] = time.Now()
+	}
+
+	if len(pc.outstanding) == 0 && pc.next >= buf.length {
+		pc.finish()
+	}
+}
+
+// pipeline is how many requests to keep in flight, no more than the peer's reqq
+func (pc *peerConn) pipeline() int {
+	if pc.ext != nil {
+		if reqq := pc.ext.Remote().Reqq; reqq > 0 && reqq < protocol.MAX_PIPELINE {
+			return reqq
+		}
+	}
+	return protocol.MAX_PIPELINE
+}
+
+func (pc *peerConn) receive(index int, begin int, block []byte) {
+	buf := pc.piece
+	// a late block from a cancelled request, drop it
+	if buf == nil || index != buf.index || pc.outstanding[begin] != len(block) {
+		util.DebugLog(fmt.Sprintf("Dropping unexpected block %d:%d", index, begin))
+		return
+	}
+
+	pc.peer.Stats.AddBlock(len(block), time.Since(pc.requestedAt[begin]))
+	delete(pc.outstanding, begin)
+	delete(pc.requestedAt, begin)
+	pc.lastBlock = time.Now()
+
+	pc.d.blockReceived(pc.peer, buf, begin, block)
+	pc.fill()
+}
+
+func (pc *peerConn) cancel(ref blockRef) {
+	if pc.piece == nil || pc.piece.index != ref.index {
+		return
+	}
+
+	blockLength, ok := pc.outstanding[ref.begin]
+	if !ok {
+		return
+	}
+
+	pc.send(protocol.NewCancelMessage(ref.index, ref.begin, blockLength))
+	delete(pc.outstanding, ref.begin)
+	delete(pc.requestedAt, ref.begin)
+	pc.fill()
+}
+
+// finish hands the piece back once every block is in, and asks for the next one
+func (pc *peerConn) finish() {
+	buf := pc.piece
+	pc.piece = nil
+	pc.d.finishPiece(pc.peer, buf)
+	pc.requestWork()
+}
+
+// release gives up on the current piece, cancelling whatever is still outstanding
+func (pc *peerConn) release() {
+	if pc.piece == nil {
+		return
+	}
+
+	for begin, blockLength := range pc.outstanding {
+		if !pc.choked {
+			pc.send(protocol.NewCancelMessage(pc.piece.index, begin, blockLength))
+		}
+		delete(pc.outstanding, begin)
+		delete(pc.requestedAt, begin)
+	}
+
+	buf := pc.piece
+	pc.piece = nil
+	pc.d.finishPiece(pc.peer, buf)
+}
+
+// sendPex tells the peer about the others we're connected to, at most once per PEX_INTERVAL
+func (pc *peerConn) sendPex() {
+	if pc.ext == nil || !pc.ext.Supports(extension.UT_PEX) {
+		return
+	}
+
+	msg, ok := pc.pex.Update(pc.d.pexPeers(pc.peer), time.Now())
+	if !ok {
+		return
+	}
+	payload, err := msg.Encode()
+	if err != nil {
+		util.DebugLog("encoding ut_pex failed: ", err)
+		return
+	}
+	pc.ext.Send(extension.UT_PEX, payload)
+}
+
+// checkSnubbed moves the piece elsewhere if the peer stopped delivering blocks.
+// A snubbed peer gets another chance after sitting out for another SnubTimeout
+func (pc *peerConn) checkSnubbed() {
+	if pc.piece == nil && pc.peer.Stats.IsSnubbed() && time.Since(pc.snubbedAt) >= pc.d.SnubTimeout {
+		pc.peer.Stats.Unsnub()
+		pc.requestWork()
+		return
+	}
+
+	if pc.piece == nil || len(pc.outstanding) == 0 || time.Since(pc.lastBlock) < pc.d.SnubTimeout {
+		return
+	}
+
+	util.Logger.Printf("Peer %s snubbed us, moving piece %d elsewhere\n", pc.peer.IP(), pc.piece.index)
+	pc.peer.Stats.Snub()
+	pc.snubbedAt = time.Now()
+	pc.release()
+}
@@ -0,0 +1,38 @@
+package worker
+
+import (
+	"sync"
+	"time"
+)
+
+// BAN_THRESHOLD is the number of pieces failing verification before a peer gets banned
+const BAN_THRESHOLD = 2
+
+// SNUB_TIMEOUT is how long a peer may go without delivering a requested block
+const SNUB_TIMEOUT = 30 * time.Second
+
+// BanList holds the IPs of peers that sent us bad data.
+// Keyed by IP rather than peer id or address so a reconnect from another port doesn't get around it.
+type BanList struct {
+	mu     sync.Mutex
+	banned map[string]time.Time
+}
+
+func NewBanList() *BanList {
+	return &BanList{banned: make(map[string]time.Time)}
+}
+
+func (b *BanList) Ban(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.banned[ip] = time.Now()
+}
+
+func (b *BanList) IsBanned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.banned[ip]
+	return ok
+}
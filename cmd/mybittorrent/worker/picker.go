@@ -0,0 +1,294 @@
+package worker
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+)
+
+// PiecePicker decides which piece should be requested next from a given peer.
+// Availability is fed in as peers come and go, so policies can be tested without any connections.
+type PiecePicker interface {
+	// PeerJoined registers all pieces advertised in a peer's bitfield
+	PeerJoined(bitfield protocol.Bitfield)
+	// PeerLeft removes a peer's pieces from the availability counts
+	PeerLeft(bitfield protocol.Bitfield)
+	// PeerHave registers a single piece announced with a have message
+	PeerHave(index int)
+	// PeerDontHave removes a single piece a peer no longer has
+	PeerDontHave(index int)
+	// Pick returns a wanted piece the peer has and marks it as in progress
+	Pick(bitfield protocol.Bitfield) (int, bool)
+	// Done marks a piece as verified
+	Done(index int)
+	// Abort returns an in progress piece to the pool
+	Abort(index int)
+	// Remaining returns the number of pieces not yet done
+	Remaining() int
+	// Wanted returns the number of pieces neither done nor in progress
+	Wanted() int
+	// InProgress lists the pieces currently being downloaded
+	InProgress() []int
+	// SetPriority changes how eagerly a piece is picked, skipped pieces are never picked
+	// and don't count as remaining
+	SetPriority(index int, priority Priority)
+}
+
+type pieceState int
+
+const (
+	pieceWanted pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// pieceSet holds the bookkeeping shared by all picking policies
+type pieceSet struct {
+	mu           sync.Mutex
+	availability []int
+	states       []pieceState
+	priorities   []Priority
+	done         int
+	// pieces skipped and not done
+	skipped int
+}
+
+func newPieceSet(numPieces int) *pieceSet {
+	priorities := make([]Priority, numPieces)
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+
+	return &pieceSet{
+		availability: make([]int, numPieces),
+		states:       make([]pieceState, numPieces),
+		priorities:   priorities,
+	}
+}
+
+func (s *pieceSet) PeerJoined(bitfield protocol.Bitfield) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.availability {
+		if bitfield.Has(i) {
+			s.availability[i]++
+		}
+	}
+}
+
+func (s *pieceSet) PeerLeft(bitfield protocol.Bitfield) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.availability {
+		if bitfield.Has(i) && s.availability[i] > 0 {
+			s.availability[i]--
+		}
+	}
+}
+
+func (s *pieceSet) PeerHave(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index >= 0 && index < len(s.availability) {
+		s.availability[index]++
+	}
+}
+
+func (s *pieceSet) PeerDontHave(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index >= 0 && index < len(s.availability) && s.availability[index] > 0 {
+		s.availability[index]--
+	}
+}
+
+func (s *pieceSet) Done(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index >= 0 && index < len(s.states) && s.states[index] != pieceDone {
+		s.states[index] = pieceDone
+		s.done++
+		if s.priorities[index] == PrioritySkip {
+			s.skipped--
+		}
+	}
+}
+
+func (s *pieceSet) SetPriority(index int, priority Priority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index >= len(s.states) || s.priorities[index] == priority {
+		return
+	}
+
+	if s.states[index] != pieceDone {
+		if priority == PrioritySkip {
+			s.skipped++
+		} else if s.priorities[index] == PrioritySkip {
+			s.skipped--
+		}
+	}
+	s.priorities[index] = priority
+}
+
+func (s *pieceSet) Abort(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index >= 0 && index < len(s.states) && s.states[index] == pieceInProgress {
+		s.states[index] = pieceWanted
+	}
+}
+
+func (s *pieceSet) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.states) - s.done - s.skipped
+}
+
+func (s *pieceSet) Wanted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := 0
+	for i, state := range s.states {
+		if state == pieceWanted && s.priorities[i] != PrioritySkip {
+			wanted++
+		}
+	}
+	return wanted
+}
+
+func (s *pieceSet) InProgress() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pieces []int
+	for i, state := range s.states {
+		if state == pieceInProgress {
+			pieces = append(pieces, i)
+		}
+	}
+	return pieces
+}
+
+// candidate reports whether the piece is wanted and the peer can serve it; caller holds the lock
+func (s *pieceSet) candidate(index int, bitfield protocol.Bitfield) bool {
+	return s.states[index] == pieceWanted && s.priorities[index] != PrioritySkip && bitfield.Has(index)
+}
+
+// SequentialPicker always picks the lowest wanted piece of the highest priority
+type SequentialPicker struct {
+	*pieceSet
+	// only pieces this close to the first one not done are picked, 0 means no limit
+	window int
+}
+
+func NewSequentialPicker(numPieces int) *SequentialPicker {
+	return &SequentialPicker{pieceSet: newPieceSet(numPieces)}
+}
+
+// NewStreamingPicker picks in order but never more than window pieces ahead of the first missing one,
+// which bounds how much has to be held back when pieces must be consumed in order
+func NewStreamingPicker(numPieces int, window int) *SequentialPicker {
+	return &SequentialPicker{pieceSet: newPieceSet(numPieces), window: window}
+}
+
+func (p *SequentialPicker) Pick(bitfield protocol.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	end := len(p.states)
+	if p.window > 0 {
+		first := 0
+		for first < len(p.states) && p.states[first] == pieceDone {
+			first++
+		}
+		if first+p.window < end {
+			end = first + p.window
+		}
+	}
+
+	picked := -1
+	for i := 0; i < end; i++ {
+		if p.candidate(i, bitfield) && (picked == -1 || p.priorities[i] > p.priorities[picked]) {
+			picked = i
+		}
+	}
+
+	if picked == -1 {
+		return -1, false
+	}
+
+	p.states[picked] = pieceInProgress
+	return picked, true
+}
+
+// RarestFirstPicker prefers pieces held by the fewest peers, within the highest priority available.
+// Until randomFirst pieces are done it picks at random instead, so that we quickly
+// have complete pieces to offer rather than all waiting on the same rare one.
+type RarestFirstPicker struct {
+	*pieceSet
+	randomFirst int
+	rng         *rand.Rand
+}
+
+func NewRarestFirstPicker(numPieces int, randomFirst int, rng *rand.Rand) *RarestFirstPicker {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(rand.Int63()))
+	}
+
+	return &RarestFirstPicker{
+		pieceSet:    newPieceSet(numPieces),
+		randomFirst: randomFirst,
+		rng:         rng,
+	}
+}
+
+func (p *RarestFirstPicker) Pick(bitfield protocol.Bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	picked := -1
+	// number of candidates seen with the current best rarity, used for reservoir sampling
+	ties := 0
+	random := p.done < p.randomFirst
+
+	for i := range p.states {
+		if !p.candidate(i, bitfield) {
+			continue
+		}
+
+		if picked != -1 && p.priorities[i] < p.priorities[picked] {
+			continue
+		}
+		if picked != -1 && p.priorities[i] > p.priorities[picked] {
+			ties = 0
+		} else if !random && picked != -1 && p.availability[i] > p.availability[picked] {
+			continue
+		} else if !random && picked != -1 && p.availability[i] < p.availability[picked] {
+			ties = 0
+		}
+
+		// break ties randomly so peers don't all converge on the same piece
+		ties++
+		if p.rng.Intn(ties) == 0 {
+			picked = i
+		}
+	}
+
+	if picked == -1 {
+		return -1, false
+	}
+
+	p.states[picked] = pieceInProgress
+	return picked, true
+}
@@ -0,0 +1,221 @@
+package worker
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+)
+
+// bitfield builds a bitfield of numPieces with the given pieces set
+func bitfield(numPieces int, pieces ...int) protocol.Bitfield {
+	bf := protocol.NewBitfield(numPieces)
+	for _, index := range pieces {
+		bf.Set(index)
+	}
+	return bf
+}
+
+func all(numPieces int) protocol.Bitfield {
+	bf := protocol.NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.Set(i)
+	}
+	return bf
+}
+
+// pickAll picks until nothing is left for the peer, returning the pieces in order
+func pickAll(p PiecePicker, peer protocol.Bitfield) []int {
+	var picked []int
+	for {
+		index, ok := p.Pick(peer)
+		if !ok {
+			return picked
+		}
+		picked = append(picked, index)
+	}
+}
+
+func equal(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRarestFirstPicker(t *testing.T) {
+	tests := []struct {
+		name  string
+		peers []protocol.Bitfield
+		// what the picking peer has
+		peer protocol.Bitfield
+		want []int
+	}{
+		{
+			name:  "rarest piece first",
+			peers: []protocol.Bitfield{all(4), bitfield(4, 0, 1, 3), bitfield(4, 1, 3), bitfield(4, 1)},
+			peer:  all(4),
+			want:  []int{2, 0, 3, 1},
+		},
+		{
+			name:  "only pieces the peer has",
+			peers: []protocol.Bitfield{all(4), bitfield(4, 0)},
+			peer:  bitfield(4, 0, 3),
+			want:  []int{3, 0},
+		},
+		{
+			name:  "nothing to pick from a peer without pieces",
+			peers: []protocol.Bitfield{all(4)},
+			peer:  bitfield(4),
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewRarestFirstPicker(4, 0, rand.New(rand.NewSource(1)))
+			for _, bf := range tt.peers {
+				p.PeerJoined(bf)
+			}
+
+			if got := pickAll(p, tt.peer); !equal(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRarestFirstPickerFollowsAvailability(t *testing.T) {
+	p := NewRarestFirstPicker(3, 0, rand.New(rand.NewSource(1)))
+	p.PeerJoined(all(3))
+	p.PeerJoined(all(3))
+	p.PeerHave(0)
+	p.PeerHave(2)
+
+	// piece 1 is the only one held by just two peers
+	if index, _ := p.Pick(all(3)); index != 1 {
+		t.Fatalf("picked %d, want 1", index)
+	}
+	p.Abort(1)
+
+	// losing two copies of piece 2 makes it the rarest
+	p.PeerDontHave(2)
+	p.PeerLeft(bitfield(3, 2))
+	if index, _ := p.Pick(all(3)); index != 2 {
+		t.Fatalf("picked %d, want 2", index)
+	}
+}
+
+func TestRarestFirstPickerRandomFirst(t *testing.T) {
+	// all pieces are equally common, the first picks may go anywhere but must not repeat
+	p := NewRarestFirstPicker(8, 4, rand.New(rand.NewSource(1)))
+	p.PeerJoined(all(8))
+
+	seen := make(map[int]bool)
+	for _, index := range pickAll(p, all(8)) {
+		if seen[index] {
+			t.Fatalf("piece %d picked twice", index)
+		}
+		seen[index] = true
+	}
+	if len(seen) != 8 {
+		t.Fatalf("picked %d pieces, want 8", len(seen))
+	}
+}
+
+func TestSequentialPicker(t *testing.T) {
+	p := NewSequentialPicker(5)
+	p.PeerJoined(all(5))
+
+	p.Done(1)
+	if got, want := pickAll(p, bitfield(5, 0, 1, 2, 4)), []int{0, 2, 4}; !equal(got, want) {
+		t.Fatalf("picked %v, want %v", got, want)
+	}
+
+	// an aborted piece comes back before anything later
+	p.Abort(2)
+	if index, _ := p.Pick(all(5)); index != 2 {
+		t.Fatalf("picked %d after abort, want 2", index)
+	}
+	if got, want := p.InProgress(), []int{0, 2, 4}; !equal(got, want) {
+		t.Fatalf("in progress %v, want %v", got, want)
+	}
+	if index, _ := p.Pick(all(5)); index != 3 {
+		t.Fatalf("picked %d, want 3", index)
+	}
+
+	if p.Wanted() != 0 || p.Remaining() != 4 {
+		t.Fatalf("wanted %d remaining %d, want 0 and 4", p.Wanted(), p.Remaining())
+	}
+}
+
+func TestPickerPriorities(t *testing.T) {
+	pickers := map[string]func() PiecePicker{
+		"sequential": func() PiecePicker {
+			return NewSequentialPicker(6)
+		},
+		"rarest first": func() PiecePicker {
+			return NewRarestFirstPicker(6, 0, rand.New(rand.NewSource(1)))
+		},
+	}
+
+	for name, newPicker := range pickers {
+		t.Run(name, func(t *testing.T) {
+			p := newPicker()
+			p.PeerJoined(all(6))
+			p.SetPriority(0, PrioritySkip)
+			p.SetPriority(1, PriorityLow)
+			p.SetPriority(4, PriorityHigh)
+			p.SetPriority(5, PrioritySkip)
+
+			got := pickAll(p, all(6))
+			if len(got) != 4 || got[0] != 4 || got[3] != 1 {
+				t.Fatalf("picked %v, want 4 first, 1 last and no skipped piece", got)
+			}
+
+			// skipped pieces don't count, unless they turn up done anyway
+			if p.Remaining() != 4 {
+				t.Fatalf("remaining %d, want 4", p.Remaining())
+			}
+			p.Done(0)
+			if p.Remaining() != 4 {
+				t.Fatalf("remaining %d after a skipped piece was done, want 4", p.Remaining())
+			}
+			p.SetPriority(5, PriorityNormal)
+			if p.Remaining() != 5 {
+				t.Fatalf("remaining %d after unskipping, want 5", p.Remaining())
+			}
+		})
+	}
+}
+
+func TestStreamingPicker(t *testing.T) {
+	p := NewStreamingPicker(10, 3)
+	p.PeerJoined(all(10))
+
+	if got, want := pickAll(p, all(10)), []int{0, 1, 2}; !equal(got, want) {
+		t.Fatalf("picked %v, want %v", got, want)
+	}
+
+	// the window only moves once the first piece is done
+	p.Done(1)
+	if _, ok := p.Pick(all(10)); ok {
+		t.Fatal("picked past the window")
+	}
+	p.Done(0)
+	if got, want := pickAll(p, all(10)), []int{3, 4}; !equal(got, want) {
+		t.Fatalf("picked %v, want %v", got, want)
+	}
+
+	// a peer without the next piece doesn't get anything beyond the window either
+	p.Done(2)
+	p.Abort(3)
+	if got, want := pickAll(p, bitfield(10, 6, 7)), []int(nil); !equal(got, want) {
+		t.Fatalf("picked %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+// Priority orders pieces within a picker, higher priorities are picked first
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = map[string]Priority{
+	"skip":   PrioritySkip,
+	"low":    PriorityLow,
+	"normal": PriorityNormal,
+	"high":   PriorityHigh,
+}
+
+func ParsePriority(name string) (Priority, error) {
+	priority, ok := priorityNames[strings.ToLower(name)]
+	if !ok {
+		return PrioritySkip, fmt.Errorf("unknown priority %q, expected skip, low, normal or high", name)
+	}
+	return priority, nil
+}
+
+func (p Priority) String() string {
+	for name, priority := range priorityNames {
+		if priority == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// FileRule gives every file matching a glob a priority
+type FileRule struct {
+	Pattern  string
+	Priority Priority
+}
+
+// matches checks the glob against the file's path within the torrent, or just its
+// name when the pattern has no slash in it
+func (r FileRule) matches(f torrent.FileEntry) bool {
+	name := f.DisplayPath()
+	if !strings.Contains(r.Pattern, "/") {
+		name = f.Path[len(f.Path)-1]
+	}
+	matched, err := path.Match(r.Pattern, name)
+	return err == nil && matched
+}
+
+// FilePriorities applies the rules in order to every file of the torrent, the last matching rule wins.
+// Files no rule matches get the default.
+func FilePriorities(info torrent.InfoDict, rules []FileRule, def Priority) ([]Priority, error) {
+	priorities := make([]Priority, len(info.Files))
+	for i := range priorities {
+		priorities[i] = def
+	}
+	err := ApplyFileRules(info, priorities, rules)
+	if err != nil {
+		return nil, err
+	}
+	return priorities, nil
+}
+
+// ApplyFileRules is FilePriorities with a priority per file to start from, which files no rule matches keep
+func ApplyFileRules(info torrent.InfoDict, priorities []Priority, rules []FileRule) error {
+	for _, r := range rules {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", r.Pattern, err)
+		}
+	}
+
+	for i, f := range info.Files {
+		for _, r := range rules {
+			if r.matches(f) {
+				priorities[i] = r.Priority
+			}
+		}
+	}
+	return nil
+}
+
+// PiecePriorities maps file priorities onto pieces. A piece shared by several files
+// gets the highest of their priorities, so a wanted file is never cut short by a skipped neighbour
+func PiecePriorities(info torrent.InfoDict, filePriorities []Priority) []Priority {
+	pieces := make([]Priority, len(info.Pieces)/20)
+	for i := range info.Files {
+		first, end := info.FilePieces(i)
+		for index := first; index < end && index < len(pieces); index++ {
+			if filePriorities[i] > pieces[index] {
+				pieces[index] = filePriorities[i]
+			}
+		}
+	}
+	return pieces
+}
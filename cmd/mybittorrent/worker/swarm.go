@@ -0,0 +1,286 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// where a candidate peer was learnt from
+const (
+	SourceTracker = "tracker"
+	SourcePEX     = "pex"
+	SourceDHT     = "dht"
+	SourceLSD     = "lsd"
+	// peers a ut_holepunch relay told us to connect to
+	SourceHolepunch = "holepunch"
+	// peers remembered in the resume file of an earlier run
+	SourceResume = "resume"
+)
+
+const (
+	// TARGET_PEERS is how many connected peers the swarm tries to keep
+	TARGET_PEERS = 30
+	// MAX_DIALS is how many connection attempts may be in flight at once
+	MAX_DIALS = 8
+	// MAX_DIAL_FAILURES drops a candidate after that many failed attempts in a row
+	MAX_DIAL_FAILURES = 5
+	// reconnect backoff doubles from RECONNECT_BACKOFF up to MAX_RECONNECT_BACKOFF
+	RECONNECT_BACKOFF     = 5 * time.Second
+	MAX_RECONNECT_BACKOFF = 5 * time.Minute
+)
+
+// candidate is an address we may connect to
+type candidate struct {
+	addr        string
+	source      string
+	failures    int
+	nextAttempt time.Time
+	dialing     bool
+	connected   bool
+}
+
+// Swarm keeps a target number of peers connected.
+// Addresses come from the tracker, PEX or DHT through AddCandidates; connected peers are
+// handed out on Peers, and the downloader reports back through Dropped when they go away,
+// after which the address is retried with exponential backoff.
+type Swarm struct {
+	Target int
+	Bans   *BanList
+	// Dial connects and handshakes with a peer, ConnectPeer with extensions unless replaced
+	Dial func(addr string) (*protocol.Peer, error)
+	// Refresh is asked for more addresses once the candidate pool runs dry, e.g. a tracker re-announce. May be nil
+	Refresh func() ([]string, error)
+
+	mu         sync.Mutex
+	candidates map[string]*candidate
+	live       map[string]*protocol.Peer
+	refreshed  bool // last refresh brought nothing new
+	peers      chan *protocol.Peer
+	wake       chan struct{}
+}
+
+func NewSwarm(infoHash []byte, target int, bans *BanList) *Swarm {
+	return &Swarm{
+		Target: target,
+		Bans:   bans,
+		Dial: func(addr string) (*protocol.Peer, error) {
+			return protocol.ConnectPeer(addr, infoHash, true)
+		},
+		candidates: make(map[string]*candidate),
+		live:       make(map[string]*protocol.Peer),
+		peers:      make(chan *protocol.Peer),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Peers delivers every newly connected peer
+func (s *Swarm) Peers() <-chan *protocol.Peer {
+	return s.peers
+}
+
+func (s *Swarm) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// AddCandidates adds addresses to the pool, ones we already know about are left alone
+func (s *Swarm) AddCandidates(addrs []string, source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		if _, ok := s.candidates[addr]; ok {
+			continue
+		}
+		s.candidates[addr] = &candidate{addr: addr, source: source}
+		added++
+	}
+
+	if added > 0 {
+		util.DebugLog(fmt.Sprintf("added %d candidates from %s", added, source))
+		s.refreshed = false
+		s.notify()
+	}
+}
+
+// Known returns the addresses worth trying again in a later run: every candidate not banned,
+// connected ones first
+func (s *Swarm) Known() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var connected, others []string
+	for addr, c := range s.candidates {
+		if s.banned(addr) {
+			continue
+		}
+		if c.connected {
+			connected = append(connected, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+	sort.Strings(connected)
+	sort.Strings(others)
+	return append(connected, others...)
+}
+
+// Dropped is called once a connected peer goes away, it will be retried after a backoff
+func (s *Swarm) Dropped(p *protocol.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.live, p.Addr)
+	if c, ok := s.candidates[p.Addr]; ok {
+		c.connected = false
+		s.backoff(c)
+	}
+	s.notify()
+}
+
+// backoff schedules the next attempt for a candidate; caller holds s.mu
+func (s *Swarm) backoff(c *candidate) {
+	c.failures++
+	if c.failures > MAX_DIAL_FAILURES {
+		util.DebugLog("dropping candidate ", c.addr)
+		delete(s.candidates, c.addr)
+		return
+	}
+
+	delay := RECONNECT_BACKOFF << (c.failures - 1)
+	if delay > MAX_RECONNECT_BACKOFF {
+		delay = MAX_RECONNECT_BACKOFF
+	}
+	c.nextAttempt = time.Now().Add(delay)
+}
+
+// banned checks the candidate's IP against the ban list
+func (s *Swarm) banned(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return s.Bans.IsBanned(host)
+}
+
+// Pending reports whether new peers may still show up: something is being dialed,
+// a candidate is waiting for its next attempt, or a refresh may bring more
+func (s *Swarm) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for addr, c := range s.candidates {
+		if c.dialing || (!c.connected && !s.banned(addr)) {
+			return true
+		}
+	}
+	return s.Refresh != nil && !s.refreshed
+}
+
+// due returns the candidates to dial now to get back up to the target; caller holds s.mu
+func (s *Swarm) due() []*candidate {
+	dialing := 0
+	for _, c := range s.candidates {
+		if c.dialing {
+			dialing++
+		}
+	}
+
+	wanted := s.Target - len(s.live) - dialing
+	if MAX_DIALS-dialing < wanted {
+		wanted = MAX_DIALS - dialing
+	}
+
+	now := time.Now()
+	var due []*candidate
+	for addr, c := range s.candidates {
+		if len(due) >= wanted {
+			break
+		}
+		if c.dialing || c.connected || now.Before(c.nextAttempt) || s.banned(addr) {
+			continue
+		}
+		due = append(due, c)
+	}
+	return due
+}
+
+// Run keeps dialing candidates until ctx is cancelled
+func (s *Swarm) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		due := s.due()
+		for _, c := range due {
+			c.dialing = true
+		}
+		needMore := len(due) == 0 && len(s.live) < s.Target && len(s.candidates) == 0 && !s.refreshed
+		s.mu.Unlock()
+
+		for _, c := range due {
+			go s.connect(ctx, c)
+		}
+
+		if needMore && s.Refresh != nil {
+			s.refresh()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Swarm) refresh() {
+	addrs, err := s.Refresh()
+	if err != nil {
+		util.Logger.Println("Error refreshing peers:", err)
+	}
+
+	s.mu.Lock()
+	s.refreshed = true
+	s.mu.Unlock()
+
+	// clears refreshed again if anything new came in
+	s.AddCandidates(addrs, SourceTracker)
+}
+
+func (s *Swarm) connect(ctx context.Context, c *candidate) {
+	p, err := s.Dial(c.addr)
+
+	s.mu.Lock()
+	c.dialing = false
+	if err != nil {
+		util.DebugLog("Error connecting to peer: ", c.addr, err)
+		s.backoff(c)
+		s.mu.Unlock()
+		s.notify()
+		return
+	}
+
+	c.failures = 0
+	c.connected = true
+	s.live[c.addr] = p
+	s.mu.Unlock()
+
+	select {
+	case s.peers <- p:
+	case <-ctx.Done():
+		p.Conn.Close()
+	}
+}
@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/protocol"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/util"
+)
+
+// WEBSEED_TIMEOUT is how long fetching a piece from a web seed may take
+const WEBSEED_TIMEOUT = time.Minute
+
+// WEBSEED_RETRY is how long a web seed rests after a failed request
+const WEBSEED_RETRY = 10 * time.Second
+
+// MAX_WEBSEED_FAILURES is how many requests in a row may fail before a web seed is given up on
+const MAX_WEBSEED_FAILURES = 3
+
+// WEBSEED_POLL is how often an idle web seed checks for pieces nobody is working on
+const WEBSEED_POLL = time.Second
+
+// webSeed downloads whole pieces from an HTTP server holding the torrent's files (BEP 19).
+// It has every piece, but never joins the endgame: the pieces left then are in the peers' hands
+type webSeed struct {
+	url string
+	// peer stands in for the web seed in the piece bookkeeping, its Addr is the URL
+	peer   *protocol.Peer
+	d      *Downloader
+	client *http.Client
+}
+
+func newWebSeed(url string, d *Downloader) *webSeed {
+	bitfield := protocol.NewBitfield(len(d.Torrent.Info.Pieces) / 20)
+	for i := 0; i < len(d.Torrent.Info.Pieces)/20; i++ {
+		bitfield.Set(i)
+	}
+	return &webSeed{
+		url:    url,
+		peer:   &protocol.Peer{Addr: url, Init: true, Bitfield: bitfield, Stats: protocol.NewPeerStats()},
+		d:      d,
+		client: &http.Client{Timeout: WEBSEED_TIMEOUT},
+	}
+}
+
+// run fetches pieces until none are left, ctx is cancelled, or the server keeps failing us
+func (ws *webSeed) run(ctx context.Context) {
+	d := ws.d
+	d.Picker.PeerJoined(ws.peer.Bitfield)
+	defer d.webSeedLeft(ws)
+
+	failures := 0
+	for d.Picker.Remaining() > 0 {
+		if d.Bans.IsBanned(ws.peer.IP()) {
+			return
+		}
+
+		wait := WEBSEED_POLL
+		if buf := d.assignWebSeed(ws.peer); buf != nil {
+			err := ws.fetch(ctx, buf)
+			d.finishPiece(ws.peer, buf)
+			if err == nil {
+				failures = 0
+				continue
+			}
+
+			failures++
+			util.DebugLog(fmt.Sprintf("web seed %s failed piece %d: %v", ws.url, buf.index, err))
+			if failures >= MAX_WEBSEED_FAILURES {
+				util.Logger.Printf("Giving up on web seed %s after %d failed requests\n", ws.url, failures)
+				return
+			}
+			wait = WEBSEED_RETRY
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fetch downloads a piece, from as many files as it spans, and hands it over block by block
+// the way a peer sends it. Verification happens as the last block is written
+func (ws *webSeed) fetch(ctx context.Context, buf *pieceBuffer) error {
+	info := ws.d.Torrent.Info
+	start := buf.index * info.PieceLength
+	data := make([]byte, buf.length)
+	requested := time.Now()
+
+	if len(info.Files) == 0 {
+		err := ws.get(ctx, ws.fileURL(info, -1), int64(start), data)
+		if err != nil {
+			return err
+		}
+	} else {
+		fileStart := 0
+		for i, f := range info.Files {
+			// the part of the piece within the file
+			lo := max(start, fileStart)
+			hi := min(start+buf.length, fileStart+f.Length)
+			if lo < hi {
+				err := ws.get(ctx, ws.fileURL(info, i), int64(lo-fileStart), data[lo-start:hi-start])
+				if err != nil {
+					return err
+				}
+			}
+			fileStart += f.Length
+		}
+	}
+	ws.peer.Stats.AddBlock(len(data), time.Since(requested))
+
+	for begin := 0; begin < len(data); begin += protocol.BLOCK_LENGTH {
+		end := min(begin+protocol.BLOCK_LENGTH, len(data))
+		ws.d.blockReceived(ws.peer, buf, begin, data[begin:end])
+	}
+	return nil
+}
+
+// get reads len(p) bytes from offset of the file at fileURL
+func (ws *webSeed) get(ctx context.Context, fileURL string, offset int64, p []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(p))-1))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server doesn't do ranges and sends the whole file
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return fmt.Errorf("%s: %v", fileURL, err)
+		}
+	default:
+		return fmt.Errorf("%s: %s", fileURL, resp.Status)
+	}
+
+	if _, err := io.ReadFull(resp.Body, p); err != nil {
+		return fmt.Errorf("%s: %v", fileURL, err)
+	}
+	return nil
+}
+
+// fileURL is where a file of the torrent is found on the web seed, -1 for a single file torrent.
+// A URL ending in a slash is a directory holding the torrent under its name, as it always is for
+// multi file torrents; otherwise it is the file itself
+func (ws *webSeed) fileURL(info torrent.InfoDict, index int) string {
+	if index == -1 && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+
+	fileURL := ws.url
+	if !strings.HasSuffix(fileURL, "/") {
+		fileURL += "/"
+	}
+	fileURL += url.PathEscape(info.Name)
+	if index >= 0 {
+		for _, component := range info.Files[index].Path {
+			fileURL += "/" + url.PathEscape(component)
+		}
+	}
+	return fileURL
+}
@@ -0,0 +1,153 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/torrent"
+)
+
+// webSeedTorrent makes up the payload and info dictionary of a torrent with the given files,
+// a single file torrent if there are none
+func webSeedTorrent(name string, lengths []int, pieceLength int) ([]byte, torrent.InfoDict) {
+	info := torrent.InfoDict{Name: name, PieceLength: pieceLength}
+	for i, length := range lengths {
+		info.Files = append(info.Files, torrent.FileEntry{Length: length, Path: []string{"dir", string(rune('a'+i)) + " file"}})
+		info.Length += length
+	}
+	if len(lengths) == 0 {
+		info.Length = 3*pieceLength + 100
+	}
+
+	payload := make([]byte, info.Length)
+	rand.New(rand.NewSource(1)).Read(payload)
+	for begin := 0; begin < len(payload); begin += pieceLength {
+		hash := sha1.Sum(payload[begin:min(begin+pieceLength, len(payload))])
+		info.Pieces = append(info.Pieces, hash[:]...)
+	}
+	return payload, info
+}
+
+// downloadFromWebSeeds runs a download of info into dir with web seeds only
+func downloadFromWebSeeds(t *testing.T, info torrent.InfoDict, dir string, webSeeds ...string) error {
+	t.Helper()
+
+	path := filepath.Join(dir, info.Name)
+	if len(info.Files) > 0 {
+		path = dir
+	}
+	store, err := storage.Open(path, info, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tm := &torrent.TorrentMetadata{Info: info}
+	d := NewDownloader(nil, tm, NewSequentialPicker(len(info.Pieces)/20), store)
+	d.WebSeeds = webSeeds
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = d.Run(ctx)
+	if err != nil {
+		return err
+	}
+	if err := d.Storage.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return d.Storage.Complete()
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	payload, info := webSeedTorrent("sample.bin", nil, 16384)
+
+	// ServeContent answers ranges, the plain handler always sends the whole file
+	handlers := map[string]http.HandlerFunc{
+		"ranges": func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, info.Name, time.Time{}, bytes.NewReader(payload))
+		},
+		"no ranges": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(payload)
+		},
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			dir := t.TempDir()
+			if err := downloadFromWebSeeds(t, info, dir, server.URL+"/files/sample.bin"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, info.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("downloaded data differs from the web seed's")
+			}
+		})
+	}
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	// pieces spanning files, and an empty file in between
+	payload, info := webSeedTorrent("sample dir", []int{20000, 0, 30000, 100}, 16384)
+
+	root := t.TempDir()
+	offset := 0
+	for _, f := range info.Files {
+		path := filepath.Join(append([]string{root, info.Name}, f.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, payload[offset:offset+f.Length], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		offset += f.Length
+	}
+	server := httptest.NewServer(http.StripPrefix("/seed/", http.FileServer(http.Dir(root))))
+	defer server.Close()
+
+	dir := t.TempDir()
+	// without the trailing slash, it's a directory all the same
+	if err := downloadFromWebSeeds(t, info, dir, server.URL+"/seed"); err != nil {
+		t.Fatal(err)
+	}
+
+	offset = 0
+	for _, f := range info.Files {
+		got, err := os.ReadFile(filepath.Join(append([]string{dir, info.Name}, f.Path...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload[offset:offset+f.Length]) {
+			t.Fatalf("%s differs from the web seed's", f.DisplayPath())
+		}
+		offset += f.Length
+	}
+}
+
+func TestWebSeedBadData(t *testing.T) {
+	payload, info := webSeedTorrent("sample.bin", nil, 16384)
+	payload[0] ^= 0xff
+	payload[len(payload)-1] ^= 0xff
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, info.Name, time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+
+	// banned after two bad pieces, with nobody left to download from
+	if err := downloadFromWebSeeds(t, info, t.TempDir(), server.URL+"/sample.bin"); err == nil {
+		t.Fatal("download from a web seed sending bad data succeeded")
+	}
+}
@@ -10,7 +10,6 @@ module github.com/codecrafters-io/bittorrent-starter-go
 
 go 1.22
 
-require (
-	github.com/jackpal/bencode-go v1.0.0 // indirect
-	github.com/ztrue/tracerr v0.4.0 // indirect
-)
+require github.com/ztrue/tracerr v0.4.0
+
+require github.com/jackpal/bencode-go v1.0.0 // indirect